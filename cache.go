@@ -1,12 +1,64 @@
 package kimg
 
-import "log"
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
 
 // KimgCache is a interface to provide cache in kimg.
 type KimgCache interface {
 	Set(key string, data []byte) error
+	// SetTTL set data which expires after ttl, 0 for never expire.
+	SetTTL(key string, data []byte, ttl time.Duration) error
 	Get(key string) ([]byte, error)
 	Del(key string) error
+	// DelPrefix delete all keys start with prefix, it returns the number of keys deleted.
+	DelPrefix(prefix string) (int, error)
+	// Flush delete all keys of kimg, keys of others sharing the server are kept.
+	Flush() error
+	Stats() (*KimgCacheStats, error)
+}
+
+// KimgCacheStats is the statistics of a cache backend.
+// counts of memory and disk cache are of this instance, of memcache and redis are of servers.
+type KimgCacheStats struct {
+	Mode      string            `json:"mode"`
+	Hits      int64             `json:"hits"`
+	Misses    int64             `json:"misses"`
+	Evictions int64             `json:"evictions"`
+	Items     int64             `json:"items"`
+	Size      int64             `json:"size"`
+	Capacity  int64             `json:"capacity"`
+	Tiers     []*KimgCacheStats `json:"tiers,omitempty"`
+}
+
+// cacheCounter count hits, misses and evictions of a cache.
+type cacheCounter struct {
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+func (counter *cacheCounter) hit() {
+	atomic.AddInt64(&counter.hits, 1)
+}
+
+func (counter *cacheCounter) miss() {
+	atomic.AddInt64(&counter.misses, 1)
+}
+
+func (counter *cacheCounter) evict() {
+	atomic.AddInt64(&counter.evictions, 1)
+}
+
+func (counter *cacheCounter) stats(mode string) *KimgCacheStats {
+	return &KimgCacheStats{
+		Mode:      mode,
+		Hits:      atomic.LoadInt64(&counter.hits),
+		Misses:    atomic.LoadInt64(&counter.misses),
+		Evictions: atomic.LoadInt64(&counter.evictions),
+	}
 }
 
 // NewKimgCache create a cache instance according to cache mode in config.
@@ -24,6 +76,12 @@ func NewKimgCache(config *KimgConfig) (KimgCache, error) {
 	case "redis":
 		log.Println("[INFO] cache [redis] used")
 		return NewKimgRedisCache(config)
+	case "disk":
+		log.Println("[INFO] cache [disk] used")
+		return NewKimgDiskCache(config)
+	case "tiered":
+		log.Printf("[INFO] cache [tiered] used, memory in front of [%s]\n", config.Cache.Tiered.L2)
+		return NewKimgTieredCache(config)
 	default:
 		log.Printf("[WARN] unsupported cache mode :%s\n", config.Cache.Mode)
 		return nil, nil
@@ -0,0 +1,376 @@
+package kimg
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskHeaderSize is the fixed part of disk cache file header: expire unix nano and key length.
+const diskHeaderSize = 8 + 2
+
+type kimgDiskCache struct {
+	mtx      sync.Mutex
+	root     string
+	list     *list.List
+	table    map[string]*list.Element
+	size     int64
+	capacity int64
+	counter  cacheCounter
+}
+
+type diskEntry struct {
+	key    string
+	file   string
+	size   int64
+	expire time.Time
+	atime  time.Time
+}
+
+// NewKimgDiskCache create a disk cache instance in root dir, the index is rebuilt from files in it.
+// Each file holds a header of expire time and key followed by data, its mtime is the last access time.
+// Eviction is LRU only, least recently accessed files are removed beyond capacity.
+func NewKimgDiskCache(config *KimgConfig) (KimgCache, error) {
+	cache := &kimgDiskCache{
+		root:     filepath.Clean(config.Cache.Disk.Root),
+		list:     list.New(),
+		table:    make(map[string]*list.Element),
+		capacity: config.Cache.Disk.Capacity,
+	}
+
+	if err := os.MkdirAll(cache.root, 0755); err != nil {
+		return nil, err
+	}
+	if err := cache.load(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("[INFO] disk cache [%s] loaded %d entries, %d bytes\n", cache.root, cache.list.Len(), cache.size)
+
+	return cache, nil
+}
+
+func (cache *kimgDiskCache) Set(key string, data []byte) error {
+	return cache.SetTTL(key, data, 0)
+}
+
+func (cache *kimgDiskCache) SetTTL(key string, data []byte, ttl time.Duration) error {
+	if len(key) > 0xffff {
+		return errors.New("disk cache key too long")
+	}
+
+	var expire time.Time
+	if ttl > 0 {
+		expire = time.Now().Add(ttl)
+	}
+
+	file := cache.filePath(key)
+	size, err := writeDiskFile(file, key, data, expire)
+	if err != nil {
+		return err
+	}
+
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	if ele := cache.table[key]; ele != nil {
+		entry := ele.Value.(*diskEntry)
+		cache.size += size - entry.size
+		entry.size = size
+		entry.expire = expire
+		cache.list.MoveToFront(ele)
+	} else {
+		entry := &diskEntry{key: key, file: file, size: size, expire: expire}
+		cache.table[key] = cache.list.PushFront(entry)
+		cache.size += size
+	}
+	cache.checkCapacity()
+
+	return nil
+}
+
+func (cache *kimgDiskCache) Get(key string) ([]byte, error) {
+	cache.mtx.Lock()
+	ele, ok := cache.table[key]
+	if ele == nil || !ok {
+		cache.mtx.Unlock()
+		cache.counter.miss()
+		return nil, errors.New("disk cache miss")
+	}
+	entry := ele.Value.(*diskEntry)
+	if !entry.expire.IsZero() && time.Now().After(entry.expire) {
+		cache.removeElement(ele)
+		cache.mtx.Unlock()
+		cache.counter.miss()
+		return nil, errors.New("disk cache expired")
+	}
+	cache.list.MoveToFront(ele)
+	file := entry.file
+	cache.mtx.Unlock()
+
+	data, err := readDiskFile(file, key)
+	if err != nil {
+		cache.mtx.Lock()
+		if ele := cache.table[key]; ele != nil && ele.Value.(*diskEntry).file == file {
+			cache.removeElement(ele)
+		}
+		cache.mtx.Unlock()
+		cache.counter.miss()
+		return nil, err
+	}
+	cache.counter.hit()
+
+	now := time.Now()
+	os.Chtimes(file, now, now)
+
+	return data, nil
+}
+
+func (cache *kimgDiskCache) Del(key string) error {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	ele, ok := cache.table[key]
+	if ele == nil || !ok {
+		return errors.New("disk cache miss")
+	}
+
+	cache.removeElement(ele)
+
+	return nil
+}
+
+func (cache *kimgDiskCache) DelPrefix(prefix string) (int, error) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	n := 0
+	for key, ele := range cache.table {
+		if strings.HasPrefix(key, prefix) {
+			cache.removeElement(ele)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (cache *kimgDiskCache) Flush() error {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	for cache.list.Len() > 0 {
+		cache.removeElement(cache.list.Back())
+	}
+	return nil
+}
+
+func (cache *kimgDiskCache) Stats() (*KimgCacheStats, error) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	stats := cache.counter.stats("disk")
+	stats.Items = int64(cache.list.Len())
+	stats.Size = cache.size
+	stats.Capacity = cache.capacity
+	return stats, nil
+}
+
+// filePath return the cache file of key, in a sub dir of root named by the first two hex of file name.
+func (cache *kimgDiskCache) filePath(key string) string {
+	m := md5.Sum([]byte(key))
+	name := hex.EncodeToString(m[:])
+	return filepath.Join(cache.root, name[:2], name)
+}
+
+func (cache *kimgDiskCache) removeElement(ele *list.Element) {
+	entry := ele.Value.(*diskEntry)
+	cache.list.Remove(ele)
+	delete(cache.table, entry.key)
+	cache.size -= entry.size
+	if err := os.Remove(entry.file); err != nil && !os.IsNotExist(err) {
+		log.Printf("[WARN] disk cache remove %s err: %s\n", entry.file, err)
+	}
+}
+
+func (cache *kimgDiskCache) checkCapacity() {
+	for cache.size > cache.capacity && cache.list.Len() > 0 {
+		cache.removeElement(cache.list.Back())
+		cache.counter.evict()
+	}
+}
+
+// load rebuild the index from cache files, least recently accessed first.
+// temp files left by interrupted writes, broken and expired cache files are removed,
+// files not named as cache files are skipped, as root may be shared with others by mistake.
+func (cache *kimgDiskCache) load() error {
+	var entries []*diskEntry
+	now := time.Now()
+
+	err := filepath.WalkDir(cache.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		name, tmp := diskFileName(cache.root, path)
+		if len(name) == 0 {
+			log.Printf("[WARN] disk cache skip unknown file %s\n", path)
+			return nil
+		}
+		if tmp {
+			os.Remove(path)
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		key, expire, err := readDiskKey(path)
+		if err != nil || cache.filePath(key) != path || (!expire.IsZero() && now.After(expire)) {
+			os.Remove(path)
+			return nil
+		}
+		entries = append(entries, &diskEntry{
+			key:    key,
+			file:   path,
+			size:   info.Size(),
+			expire: expire,
+			atime:  info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].atime.Before(entries[j].atime)
+	})
+	for _, entry := range entries {
+		cache.table[entry.key] = cache.list.PushFront(entry)
+		cache.size += entry.size
+	}
+	cache.checkCapacity()
+
+	return nil
+}
+
+// diskFileName check whether path under root is a cache file <2hex>/<32hex> or its temp file <32hex>.*.tmp,
+// it returns the hex name of cache file, or empty if not.
+func diskFileName(root, path string) (string, bool) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", false
+	}
+	dir, name := filepath.Split(rel)
+	tmp := strings.HasSuffix(name, ".tmp")
+	if tmp {
+		name = strings.SplitN(name, ".", 2)[0]
+	}
+	if len(name) != 2*md5.Size || !isHex(name) || filepath.Clean(dir) != name[:2] {
+		return "", false
+	}
+	return name, tmp
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
+
+// writeDiskFile write a cache file to a temp file and rename it to file once synced,
+// so that a crash never leaves a partial file, it returns the size of file written.
+func writeDiskFile(file, key string, data []byte, expire time.Time) (int64, error) {
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	f, err := ioutil.TempFile(dir, filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	header := make([]byte, diskHeaderSize, diskHeaderSize+len(key))
+	if !expire.IsZero() {
+		binary.BigEndian.PutUint64(header, uint64(expire.UnixNano()))
+	}
+	binary.BigEndian.PutUint16(header[8:], uint16(len(key)))
+	header = append(header, key...)
+
+	w := bufio.NewWriter(f)
+	w.Write(header)
+	w.Write(data)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(f.Name(), file); err != nil {
+		return 0, err
+	}
+	return int64(len(header) + len(data)), nil
+}
+
+// readDiskFile read data of a cache file, and check the key in header.
+func readDiskFile(file, key string) ([]byte, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < diskHeaderSize {
+		return nil, errors.New("disk cache file broken")
+	}
+	n := diskHeaderSize + int(binary.BigEndian.Uint16(b[8:]))
+	if len(b) < n || string(b[diskHeaderSize:n]) != key {
+		return nil, errors.New("disk cache file broken")
+	}
+	return b[n:], nil
+}
+
+// readDiskKey read the key and expire time in header of a cache file.
+func readDiskKey(file string) (string, time.Time, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer f.Close()
+
+	header := make([]byte, diskHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return "", time.Time{}, err
+	}
+	key := make([]byte, binary.BigEndian.Uint16(header[8:]))
+	if _, err := io.ReadFull(f, key); err != nil {
+		return "", time.Time{}, err
+	}
+
+	var expire time.Time
+	if nano := binary.BigEndian.Uint64(header); nano > 0 {
+		expire = time.Unix(0, int64(nano))
+	}
+	return string(key), expire, nil
+}
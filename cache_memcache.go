@@ -1,11 +1,29 @@
 package kimg
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/bradfitz/gomemcache/memcache"
 )
 
+// memcacheMaxRelativeTTL expirations longer than 30 days are taken by memcached as unix time.
+const memcacheMaxRelativeTTL = 30 * 24 * time.Hour
+
+// memcacheAdminTimeout is the timeout of stats and metadump commands, which may reply lots of lines.
+const memcacheAdminTimeout = 30 * time.Second
+
 type kimgMemcacheCache struct {
 	client *memcache.Client
+	addr   string
+	prefix string
 }
 
 // NewKimgMemcacheCache create a memcache cache instance.
@@ -14,16 +32,27 @@ func NewKimgMemcacheCache(config *KimgConfig) (KimgCache, error) {
 
 	return &kimgMemcacheCache{
 		client: client,
+		addr:   config.Cache.Memcache.URL,
+		prefix: config.Cache.Prefix,
 	}, nil
 }
 
 func (cache *kimgMemcacheCache) Set(key string, data []byte) error {
-	it := &memcache.Item{Key: key, Value: data}
+	return cache.SetTTL(key, data, 0)
+}
+
+func (cache *kimgMemcacheCache) SetTTL(key string, data []byte, ttl time.Duration) error {
+	it := &memcache.Item{Key: cache.prefix + key, Value: data}
+	if ttl > memcacheMaxRelativeTTL {
+		it.Expiration = int32(time.Now().Add(ttl).Unix())
+	} else if ttl > 0 {
+		it.Expiration = int32(maxInt(1, int(ttl.Seconds())))
+	}
 	return cache.client.Set(it)
 }
 
 func (cache *kimgMemcacheCache) Get(key string) ([]byte, error) {
-	it, err := cache.client.Get(key)
+	it, err := cache.client.Get(cache.prefix + key)
 	if err != nil {
 		return nil, err
 	}
@@ -31,5 +60,95 @@ func (cache *kimgMemcacheCache) Get(key string) ([]byte, error) {
 }
 
 func (cache *kimgMemcacheCache) Del(key string) error {
-	return cache.client.Delete(key)
+	return cache.client.Delete(cache.prefix + key)
+}
+
+// DelPrefix find keys by lru_crawler metadump, which requires memcached 1.4.31 or later.
+func (cache *kimgMemcacheCache) DelPrefix(prefix string) (int, error) {
+	prefix = cache.prefix + prefix
+	var keys []string
+	err := memcacheCommand(cache.addr, "lru_crawler metadump all", func(line string) {
+		for _, field := range strings.Fields(line) {
+			if !strings.HasPrefix(field, "key=") {
+				continue
+			}
+			if key, err := url.PathUnescape(field[4:]); err == nil && strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, key := range keys {
+		if err := cache.client.Delete(key); err == nil {
+			n++
+		} else if err != memcache.ErrCacheMiss {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Flush delete keys of kimg only, as memcached may be shared with others.
+func (cache *kimgMemcacheCache) Flush() error {
+	_, err := cache.DelPrefix("")
+	return err
+}
+
+func (cache *kimgMemcacheCache) Stats() (*KimgCacheStats, error) {
+	fields := make(map[string]int64)
+	err := memcacheCommand(cache.addr, "stats", func(line string) {
+		s := strings.Fields(line)
+		if len(s) == 3 && s[0] == "STAT" {
+			if v, err := strconv.ParseInt(s[2], 10, 64); err == nil {
+				fields[s[1]] = v
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &KimgCacheStats{
+		Mode:      "memcache",
+		Hits:      fields["get_hits"],
+		Misses:    fields["get_misses"],
+		Evictions: fields["evictions"],
+		Items:     fields["curr_items"],
+		Size:      fields["bytes"],
+		Capacity:  fields["limit_maxbytes"],
+	}, nil
+}
+
+// memcacheCommand send a command to memcached server at addr, and call fn with each line replied until END.
+func memcacheCommand(addr, cmd string, fn func(line string)) error {
+	conn, err := net.DialTimeout("tcp", addr, memcacheAdminTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(memcacheAdminTimeout))
+	if _, err := fmt.Fprintf(conn, "%s\r\n", cmd); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "END":
+			return nil
+		case line == "ERROR", strings.HasPrefix(line, "BUSY"), strings.HasPrefix(line, "CLIENT_ERROR"), strings.HasPrefix(line, "SERVER_ERROR"):
+			return errors.New("memcache " + cmd + ": " + line)
+		}
+		fn(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
 }
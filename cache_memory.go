@@ -3,7 +3,9 @@ package kimg
 import (
 	"container/list"
 	"errors"
+	"strings"
 	"sync"
+	"time"
 )
 
 type kimgMemoryCache struct {
@@ -12,12 +14,14 @@ type kimgMemoryCache struct {
 	table    map[string]*list.Element
 	size     int64
 	capacity int64
+	counter  cacheCounter
 }
 
 type cacheEntry struct {
-	key  string
-	data []byte
-	size int64
+	key    string
+	data   []byte
+	size   int64
+	expire time.Time
 }
 
 // NewKimgMemoryCache create a memory cache instance.
@@ -30,13 +34,22 @@ func NewKimgMemoryCache(config *KimgConfig) (KimgCache, error) {
 }
 
 func (cache *kimgMemoryCache) Set(key string, data []byte) error {
+	return cache.SetTTL(key, data, 0)
+}
+
+func (cache *kimgMemoryCache) SetTTL(key string, data []byte, ttl time.Duration) error {
 	cache.mtx.Lock()
 	defer cache.mtx.Unlock()
 
+	var expire time.Time
+	if ttl > 0 {
+		expire = time.Now().Add(ttl)
+	}
+
 	if ele := cache.table[key]; ele != nil {
-		cache.updateInplace(ele, data)
+		cache.updateInplace(ele, data, expire)
 	} else {
-		cache.addNew(key, data)
+		cache.addNew(key, data, expire)
 	}
 	return nil
 }
@@ -47,9 +60,16 @@ func (cache *kimgMemoryCache) Get(key string) ([]byte, error) {
 
 	ele, ok := cache.table[key]
 	if ele == nil || !ok {
+		cache.counter.miss()
 		return nil, errors.New("memory cache miss")
 	}
+	if entry := ele.Value.(*cacheEntry); !entry.expire.IsZero() && time.Now().After(entry.expire) {
+		cache.removeElement(ele)
+		cache.counter.miss()
+		return nil, errors.New("memory cache expired")
+	}
 	cache.moveToFront(ele)
+	cache.counter.hit()
 
 	return ele.Value.(*cacheEntry).data, nil
 }
@@ -63,17 +83,51 @@ func (cache *kimgMemoryCache) Del(key string) error {
 		return errors.New("memory cache miss")
 	}
 
-	cache.list.Remove(ele)
-	delete(cache.table, key)
-	cache.size -= ele.Value.(*cacheEntry).size
+	cache.removeElement(ele)
+
+	return nil
+}
+
+func (cache *kimgMemoryCache) DelPrefix(prefix string) (int, error) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	n := 0
+	for key, ele := range cache.table {
+		if strings.HasPrefix(key, prefix) {
+			cache.removeElement(ele)
+			n++
+		}
+	}
+	return n, nil
+}
 
+func (cache *kimgMemoryCache) Flush() error {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	cache.list.Init()
+	cache.table = make(map[string]*list.Element)
+	cache.size = 0
 	return nil
 }
 
-func (cache *kimgMemoryCache) updateInplace(ele *list.Element, data []byte) {
+func (cache *kimgMemoryCache) Stats() (*KimgCacheStats, error) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	stats := cache.counter.stats("memory")
+	stats.Items = int64(cache.list.Len())
+	stats.Size = cache.size
+	stats.Capacity = cache.capacity
+	return stats, nil
+}
+
+func (cache *kimgMemoryCache) updateInplace(ele *list.Element, data []byte, expire time.Time) {
 	cache.size += int64(len(data)) - ele.Value.(*cacheEntry).size
 	ele.Value.(*cacheEntry).data = data
 	ele.Value.(*cacheEntry).size = int64(len(data))
+	ele.Value.(*cacheEntry).expire = expire
 	cache.moveToFront(ele)
 	cache.checkCapacity()
 }
@@ -82,20 +136,24 @@ func (cache *kimgMemoryCache) moveToFront(ele *list.Element) {
 	cache.list.MoveToFront(ele)
 }
 
-func (cache *kimgMemoryCache) addNew(key string, data []byte) {
-	entry := &cacheEntry{key, data, int64(len(data))}
+func (cache *kimgMemoryCache) addNew(key string, data []byte, expire time.Time) {
+	entry := &cacheEntry{key, data, int64(len(data)), expire}
 	ele := cache.list.PushFront(entry)
 	cache.table[key] = ele
 	cache.size += entry.size
 	cache.checkCapacity()
 }
 
+func (cache *kimgMemoryCache) removeElement(ele *list.Element) {
+	entry := ele.Value.(*cacheEntry)
+	cache.list.Remove(ele)
+	delete(cache.table, entry.key)
+	cache.size -= entry.size
+}
+
 func (cache *kimgMemoryCache) checkCapacity() {
 	for cache.size > cache.capacity {
-		ele := cache.list.Back()
-		entry := ele.Value.(*cacheEntry)
-		cache.list.Remove(ele)
-		delete(cache.table, entry.key)
-		cache.size -= entry.size
+		cache.removeElement(cache.list.Back())
+		cache.counter.evict()
 	}
 }
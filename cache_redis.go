@@ -2,64 +2,242 @@ package kimg
 
 import (
 	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 )
 
+// redisRoleCheckInterval is the idle time after which a sentinel master connection is checked for role on borrow.
+const redisRoleCheckInterval = time.Second
+
 type kimgRedisCache struct {
+	client redisClient
+	prefix string
+}
+
+// redisClient is a interface to send a command of key to the redis server serving it.
+type redisClient interface {
+	Do(key, cmd string, args ...interface{}) (interface{}, error)
+	// Pools return the pools of all masters, for commands not of a key.
+	Pools() []*redis.Pool
+}
+
+type redisPoolClient struct {
 	pool *redis.Pool
 }
 
-// NewKimgRedisCache create a redis cache instance.
+// NewKimgRedisCache create a redis cache instance, of a single server, a sentinel monitored master or a cluster.
 func NewKimgRedisCache(config *KimgConfig) (KimgCache, error) {
-	pool := &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", config.Cache.Redis.URL)
-			if err != nil {
-				return nil, err
+	if len(config.Cache.Redis.Cluster.Addrs) > 0 {
+		cluster, err := newRedisCluster(config)
+		if err != nil {
+			return nil, err
+		}
+		return &kimgRedisCache{client: cluster, prefix: config.Cache.Prefix}, nil
+	}
+
+	return &kimgRedisCache{
+		client: &redisPoolClient{pool: newRedisPool(config)},
+		prefix: config.Cache.Prefix,
+	}, nil
+}
+
+// newRedisPool create a pool of connections to the redis server in config,
+// the master discovered by sentinel, or any node of cluster.
+func newRedisPool(config *KimgConfig) *redis.Pool {
+	pool := newRedisNodePool(config, func() (redis.Conn, error) {
+		return dialRedisServer(config)
+	})
+	if len(config.Cache.Redis.Sentinel.Master) > 0 {
+		// connections to the old master are stale after failover, check role of connections idle for a while.
+		pool.TestOnBorrow = func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < redisRoleCheckInterval {
+				return nil
 			}
-			return c, err
-		},
+			return checkRedisMaster(c)
+		}
+	}
+	return pool
+}
+
+func newRedisNodePool(config *KimgConfig, dial func() (redis.Conn, error)) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     config.Cache.Redis.Pool.MaxIdle,
+		MaxActive:   config.Cache.Redis.Pool.MaxActive,
+		IdleTimeout: time.Duration(config.Cache.Redis.Pool.IdleTimeout) * time.Second,
+		Wait:        config.Cache.Redis.Pool.MaxActive > 0,
+		Dial:        dial,
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
 			_, err := c.Do("PING")
 			return err
 		},
 	}
-	return &kimgRedisCache{
-		pool: pool,
-	}, nil
 }
 
-func (cache *kimgRedisCache) getConnect() (redis.Conn, error) {
-	conn := cache.pool.Get()
-	if conn == nil {
-		return nil, errors.New("can not connect to redis server")
+func dialRedisServer(config *KimgConfig) (redis.Conn, error) {
+	if len(config.Cache.Redis.Sentinel.Master) > 0 {
+		addr, err := sentinelMaster(config)
+		if err != nil {
+			return nil, err
+		}
+		c, err := dialRedis(config, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkRedisMaster(c); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("redis %s %s", addr, err)
+		}
+		return &redisMasterConn{Conn: c}, nil
+	}
+
+	if addrs := config.Cache.Redis.Cluster.Addrs; len(addrs) > 0 {
+		var err error
+		for _, addr := range addrs {
+			var c redis.Conn
+			if c, err = dialRedis(config, addr); err == nil {
+				return c, nil
+			}
+		}
+		return nil, err
 	}
-	return conn, nil
+
+	return dialRedis(config, "")
 }
 
-func (cache *kimgRedisCache) Set(key string, data []byte) error {
-	conn, err := cache.getConnect()
+// checkRedisMaster check the role of server connected is master.
+func checkRedisMaster(c redis.Conn) error {
+	role, err := redis.Values(c.Do("ROLE"))
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
+	if len(role) > 0 {
+		if name, err := redis.String(role[0], nil); err != nil {
+			return err
+		} else if name != "master" {
+			return fmt.Errorf("is not master but %s", name)
+		}
+	}
+	return nil
+}
 
-	_, err = redis.Bytes(conn.Do("SET", key, data))
-	return err
+// redisMasterConn is a connection to the master discovered by sentinel,
+// it is broken on READONLY error, so that the pool closes it instead of reusing it after failover.
+type redisMasterConn struct {
+	redis.Conn
+	err error
 }
 
-func (cache *kimgRedisCache) Get(key string) ([]byte, error) {
-	conn, err := cache.getConnect()
+func (c *redisMasterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(cmd, args...)
+	if rerr, ok := err.(redis.Error); ok && strings.HasPrefix(string(rerr), "READONLY") {
+		c.err = rerr
+	}
+	return reply, err
+}
+
+func (c *redisMasterConn) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.Conn.Err()
+}
+
+// dialRedis dial the redis server at addr, with auth, db and tls in url of config.
+// the host in url is used if addr is empty.
+func dialRedis(config *KimgConfig, addr string) (redis.Conn, error) {
+	opts := redisDialOptions(config)
+
+	rawurl := config.Cache.Redis.URL
+	if !strings.Contains(rawurl, "://") {
+		if len(addr) == 0 {
+			addr = rawurl
+		}
+		return redis.Dial("tcp", addr, opts...)
+	}
+
+	u, err := url.Parse(rawurl)
 	if err != nil {
 		return nil, err
 	}
+	if len(addr) > 0 {
+		u.Host = addr
+	}
+	if len(config.Cache.Redis.Cluster.Addrs) > 0 {
+		// cluster supports db 0 only.
+		u.Path = ""
+	}
+	return redis.DialURL(u.String(), opts...)
+}
+
+func redisDialOptions(config *KimgConfig) []redis.DialOption {
+	timeout := config.Cache.Redis.Timeout
+	return []redis.DialOption{
+		redis.DialConnectTimeout(time.Duration(timeout.Connect) * time.Millisecond),
+		redis.DialReadTimeout(time.Duration(timeout.Read) * time.Millisecond),
+		redis.DialWriteTimeout(time.Duration(timeout.Write) * time.Millisecond),
+	}
+}
+
+// sentinelMaster ask sentinels in turn for the address of master.
+func sentinelMaster(config *KimgConfig) (string, error) {
+	sentinel := config.Cache.Redis.Sentinel
+	err := errors.New("no redis sentinel configured")
+	for _, addr := range sentinel.Addrs {
+		opts := append(redisDialOptions(config), redis.DialPassword(sentinel.Password))
+		var c redis.Conn
+		if c, err = redis.Dial("tcp", addr, opts...); err != nil {
+			continue
+		}
+		var master []string
+		master, err = redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", sentinel.Master))
+		c.Close()
+		if err != nil {
+			continue
+		}
+		if len(master) != 2 {
+			err = fmt.Errorf("redis sentinel %s invalid master reply", addr)
+			continue
+		}
+		return net.JoinHostPort(master[0], master[1]), nil
+	}
+	return "", err
+}
+
+func (client *redisPoolClient) Do(key, cmd string, args ...interface{}) (interface{}, error) {
+	conn := client.pool.Get()
 	defer conn.Close()
 
-	data, err := redis.Bytes(conn.Do("GET", key))
+	return conn.Do(cmd, args...)
+}
+
+func (client *redisPoolClient) Pools() []*redis.Pool {
+	return []*redis.Pool{client.pool}
+}
+
+func (cache *kimgRedisCache) Set(key string, data []byte) error {
+	return cache.SetTTL(key, data, 0)
+}
+
+func (cache *kimgRedisCache) SetTTL(key string, data []byte, ttl time.Duration) error {
+	key = cache.prefix + key
+	var err error
+	if ttl > 0 {
+		_, err = cache.client.Do(key, "SET", key, data, "PX", ttl.Milliseconds())
+	} else {
+		_, err = cache.client.Do(key, "SET", key, data)
+	}
+	return err
+}
+
+func (cache *kimgRedisCache) Get(key string) ([]byte, error) {
+	key = cache.prefix + key
+	data, err := redis.Bytes(cache.client.Do(key, "GET", key))
 	if err != nil {
 		return nil, err
 	}
@@ -67,12 +245,108 @@ func (cache *kimgRedisCache) Get(key string) ([]byte, error) {
 }
 
 func (cache *kimgRedisCache) Del(key string) error {
-	conn, err := cache.getConnect()
-	if err != nil {
-		return err
+	key = cache.prefix + key
+	_, err := cache.client.Do(key, "DEL", key)
+	return err
+}
+
+func (cache *kimgRedisCache) DelPrefix(prefix string) (int, error) {
+	n := 0
+	for _, pool := range cache.client.Pools() {
+		count, err := redisDelMatch(pool, redisGlobEscape(cache.prefix+prefix)+"*")
+		n += count
+		if err != nil {
+			return n, err
+		}
 	}
-	defer conn.Close()
+	return n, nil
+}
 
-	_, err = redis.Bytes(conn.Do("DEL", key))
+// Flush delete keys of kimg only, as redis may be shared with others.
+func (cache *kimgRedisCache) Flush() error {
+	_, err := cache.DelPrefix("")
 	return err
 }
+
+func (cache *kimgRedisCache) Stats() (*KimgCacheStats, error) {
+	stats := &KimgCacheStats{Mode: "redis"}
+	for _, pool := range cache.client.Pools() {
+		conn := pool.Get()
+		info, err := redis.String(conn.Do("INFO"))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		items, err := redis.Int64(conn.Do("DBSIZE"))
+		conn.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		fields := parseRedisInfo(info)
+		stats.Hits += fields["keyspace_hits"]
+		stats.Misses += fields["keyspace_misses"]
+		stats.Evictions += fields["evicted_keys"]
+		stats.Size += fields["used_memory"]
+		stats.Capacity += fields["maxmemory"]
+		stats.Items += items
+	}
+	return stats, nil
+}
+
+// redisDelMatch delete keys match pattern of a server by SCAN, it returns the number of keys deleted.
+func redisDelMatch(pool *redis.Pool, pattern string) (int, error) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	n := 0
+	cursor := "0"
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return n, err
+		}
+		if len(values) != 2 {
+			return n, errors.New("invalid scan reply")
+		}
+		cursor, _ = redis.String(values[0], nil)
+		keys, _ := redis.Strings(values[1], nil)
+		for _, key := range keys {
+			// keys are deleted one by one, as keys of different slots can not be deleted together in cluster.
+			if _, err := conn.Do("DEL", key); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if cursor == "0" {
+			return n, nil
+		}
+	}
+}
+
+// redisGlobEscape escape the special characters of glob style pattern in s.
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\^`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// parseRedisInfo parse the integer fields of INFO reply.
+func parseRedisInfo(info string) map[string]int64 {
+	fields := make(map[string]int64)
+	for _, line := range strings.Split(info, "\r\n") {
+		s := strings.SplitN(line, ":", 2)
+		if len(s) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseInt(s[1], 10, 64); err == nil {
+			fields[s[0]] = v
+		}
+	}
+	return fields
+}
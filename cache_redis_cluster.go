@@ -0,0 +1,210 @@
+package kimg
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// redisClusterSlots is the number of hash slots of redis cluster.
+	redisClusterSlots = 16384
+	// redisClusterRedirects is the max MOVED or ASK redirections followed by a command.
+	redisClusterRedirects = 5
+)
+
+// redisCluster route commands to the master serving the hash slot of key,
+// the slot map is loaded by CLUSTER SLOTS and reloaded on MOVED redirection or connection error.
+type redisCluster struct {
+	config *KimgConfig
+	mtx    sync.RWMutex
+	slots  [redisClusterSlots]string
+	pools  map[string]*redis.Pool
+}
+
+func newRedisCluster(config *KimgConfig) (*redisCluster, error) {
+	cluster := &redisCluster{
+		config: config,
+		pools:  make(map[string]*redis.Pool),
+	}
+	if err := cluster.refresh(); err != nil {
+		return nil, err
+	}
+	return cluster, nil
+}
+
+func (cluster *redisCluster) Do(key, cmd string, args ...interface{}) (interface{}, error) {
+	slot := redisSlot(key)
+	addr := cluster.slotAddr(slot)
+	asking := false
+	refreshed := false
+
+	for i := 0; i < redisClusterRedirects; i++ {
+		if len(addr) == 0 {
+			if err := cluster.refresh(); err != nil {
+				return nil, err
+			}
+			refreshed = true
+			if addr = cluster.slotAddr(slot); len(addr) == 0 {
+				return nil, fmt.Errorf("redis cluster slot %d not served", slot)
+			}
+		}
+
+		conn := cluster.pool(addr).Get()
+		if asking {
+			conn.Do("ASKING")
+		}
+		reply, err := conn.Do(cmd, args...)
+		conn.Close()
+
+		if rerr, ok := err.(redis.Error); ok {
+			s := strings.Fields(string(rerr))
+			if len(s) == 3 && (s[0] == "MOVED" || s[0] == "ASK") {
+				addr = s[2]
+				asking = s[0] == "ASK"
+				if !asking {
+					cluster.mtx.Lock()
+					cluster.slots[slot] = addr
+					cluster.mtx.Unlock()
+					go cluster.refresh()
+				}
+				continue
+			}
+		} else if err != nil && !refreshed {
+			// the node may be down and failed over, reload the slot map and retry.
+			addr = ""
+			asking = false
+			continue
+		}
+		return reply, err
+	}
+	return nil, errors.New("too many redis cluster redirections")
+}
+
+func (cluster *redisCluster) Pools() []*redis.Pool {
+	cluster.mtx.RLock()
+	addrs := make(map[string]bool)
+	for _, addr := range cluster.slots {
+		if len(addr) > 0 {
+			addrs[addr] = true
+		}
+	}
+	cluster.mtx.RUnlock()
+
+	pools := make([]*redis.Pool, 0, len(addrs))
+	for addr := range addrs {
+		pools = append(pools, cluster.pool(addr))
+	}
+	return pools
+}
+
+func (cluster *redisCluster) slotAddr(slot int) string {
+	cluster.mtx.RLock()
+	defer cluster.mtx.RUnlock()
+
+	return cluster.slots[slot]
+}
+
+func (cluster *redisCluster) pool(addr string) *redis.Pool {
+	cluster.mtx.Lock()
+	defer cluster.mtx.Unlock()
+
+	pool := cluster.pools[addr]
+	if pool == nil {
+		pool = newRedisNodePool(cluster.config, func() (redis.Conn, error) {
+			return dialRedis(cluster.config, addr)
+		})
+		cluster.pools[addr] = pool
+	}
+	return pool
+}
+
+// refresh load the slot map from the first node answered, seed nodes in config and known masters.
+func (cluster *redisCluster) refresh() error {
+	addrs := append([]string{}, cluster.config.Cache.Redis.Cluster.Addrs...)
+	cluster.mtx.RLock()
+	for addr := range cluster.pools {
+		addrs = append(addrs, addr)
+	}
+	cluster.mtx.RUnlock()
+
+	err := errors.New("no redis cluster node configured")
+	for _, addr := range addrs {
+		var slots [redisClusterSlots]string
+		if slots, err = cluster.loadSlots(addr); err != nil {
+			log.Printf("[WARN] redis cluster %s load slots err: %s\n", addr, err)
+			continue
+		}
+		cluster.mtx.Lock()
+		cluster.slots = slots
+		cluster.mtx.Unlock()
+		return nil
+	}
+	return err
+}
+
+func (cluster *redisCluster) loadSlots(addr string) ([redisClusterSlots]string, error) {
+	var slots [redisClusterSlots]string
+
+	conn := cluster.pool(addr).Get()
+	defer conn.Close()
+
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return slots, err
+	}
+	for _, r := range ranges {
+		v, err := redis.Values(r, nil)
+		if err != nil || len(v) < 3 {
+			return slots, errors.New("invalid cluster slots reply")
+		}
+		start, _ := redis.Int(v[0], nil)
+		end, _ := redis.Int(v[1], nil)
+		master, err := redis.Values(v[2], nil)
+		if err != nil || len(master) < 2 || start < 0 || end >= redisClusterSlots {
+			return slots, errors.New("invalid cluster slots reply")
+		}
+		host, _ := redis.String(master[0], nil)
+		port, _ := redis.Int(master[1], nil)
+		if len(host) == 0 {
+			// empty host means the node answered.
+			host, _, _ = net.SplitHostPort(addr)
+		}
+		for i := start; i <= end; i++ {
+			slots[i] = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+	}
+	return slots, nil
+}
+
+// redisSlot return the hash slot of key, only the hash tag inside {} is hashed if any.
+func redisSlot(key string) int {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return int(crc16(key)) % redisClusterSlots
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum used by redis cluster.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,187 @@
+package kimg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+type kimgTieredCache struct {
+	l1      KimgCache
+	l2      KimgCache
+	l1TTL   time.Duration
+	pool    *redis.Pool
+	channel string
+	id      string
+}
+
+// NewKimgTieredCache create a tiered cache instance, memory cache as L1 in front of redis or memcache as L2.
+// L1 of other instances are invalidated on delete via redis pub/sub if channel configured and L2 is redis.
+func NewKimgTieredCache(config *KimgConfig) (KimgCache, error) {
+	l1, err := NewKimgMemoryCache(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var l2 KimgCache
+	switch config.Cache.Tiered.L2 {
+	case "redis":
+		l2, err = NewKimgRedisCache(config)
+	case "memcache":
+		l2, err = NewKimgMemcacheCache(config)
+	default:
+		err = fmt.Errorf("unsupported tiered cache l2 mode: %s", config.Cache.Tiered.L2)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &kimgTieredCache{
+		l1:      l1,
+		l2:      l2,
+		l1TTL:   time.Duration(config.Cache.Tiered.L1TTL) * time.Second,
+		channel: config.Cache.Tiered.Channel,
+	}
+
+	if len(cache.channel) > 0 && config.Cache.Tiered.L2 != "redis" {
+		log.Printf("[INFO] tiered cache channel %s ignored, as l2 %s is not redis\n", cache.channel, config.Cache.Tiered.L2)
+		cache.channel = ""
+	}
+
+	if len(cache.channel) > 0 {
+		id := make([]byte, 8)
+		rand.Read(id)
+		cache.id = hex.EncodeToString(id)
+		cache.pool = newRedisPool(config)
+		go cache.subscribe()
+	}
+
+	return cache, nil
+}
+
+func (cache *kimgTieredCache) Set(key string, data []byte) error {
+	return cache.SetTTL(key, data, 0)
+}
+
+func (cache *kimgTieredCache) SetTTL(key string, data []byte, ttl time.Duration) error {
+	if err := cache.l2.SetTTL(key, data, ttl); err != nil {
+		return err
+	}
+	return cache.l1.SetTTL(key, data, cache.localTTL(ttl))
+}
+
+func (cache *kimgTieredCache) Get(key string) ([]byte, error) {
+	if data, err := cache.l1.Get(key); err == nil {
+		return data, nil
+	}
+
+	data, err := cache.l2.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	cache.l1.SetTTL(key, data, cache.l1TTL)
+	return data, nil
+}
+
+func (cache *kimgTieredCache) Del(key string) error {
+	cache.l1.Del(key)
+	err := cache.l2.Del(key)
+	cache.publish("del", key)
+	return err
+}
+
+func (cache *kimgTieredCache) DelPrefix(prefix string) (int, error) {
+	cache.l1.DelPrefix(prefix)
+	n, err := cache.l2.DelPrefix(prefix)
+	cache.publish("prefix", prefix)
+	return n, err
+}
+
+func (cache *kimgTieredCache) Flush() error {
+	cache.l1.Flush()
+	err := cache.l2.Flush()
+	cache.publish("flush", "")
+	return err
+}
+
+// Stats return the stats of L2 with both tiers.
+func (cache *kimgTieredCache) Stats() (*KimgCacheStats, error) {
+	l1, _ := cache.l1.Stats()
+	l2, err := cache.l2.Stats()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := *l2
+	stats.Mode = "tiered"
+	stats.Tiers = []*KimgCacheStats{l1, l2}
+	return &stats, nil
+}
+
+// localTTL return the L1 expiry, which is no longer than l1TTL.
+func (cache *kimgTieredCache) localTTL(ttl time.Duration) time.Duration {
+	if cache.l1TTL > 0 && (ttl <= 0 || ttl > cache.l1TTL) {
+		return cache.l1TTL
+	}
+	return ttl
+}
+
+// publish notify other instances to drop key, keys with prefix or all from L1, by op "del", "prefix" or "flush".
+func (cache *kimgTieredCache) publish(op, key string) {
+	if cache.pool == nil {
+		return
+	}
+
+	conn := cache.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("PUBLISH", cache.channel, cache.id+" "+op+" "+key); err != nil {
+		log.Printf("[WARN] tiered cache publish %s %s err: %s\n", op, key, err)
+	}
+}
+
+// subscribe drop keys deleted by other instances from L1, and reconnect if subscription broken.
+func (cache *kimgTieredCache) subscribe() {
+	for {
+		if err := cache.receive(); err != nil {
+			log.Printf("[WARN] tiered cache subscribe %s err: %s\n", cache.channel, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (cache *kimgTieredCache) receive() error {
+	conn := cache.pool.Get()
+	defer conn.Close()
+
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(cache.channel); err != nil {
+		return err
+	}
+
+	for {
+		// block without read timeout, as messages may be rare.
+		switch v := psc.ReceiveWithTimeout(0).(type) {
+		case redis.Message:
+			s := strings.SplitN(string(v.Data), " ", 3)
+			if len(s) != 3 || s[0] == cache.id {
+				continue
+			}
+			switch s[1] {
+			case "del":
+				cache.l1.Del(s[2])
+			case "prefix":
+				cache.l1.DelPrefix(s[2])
+			case "flush":
+				cache.l1.Flush()
+			}
+		case error:
+			return v
+		}
+	}
+}
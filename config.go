@@ -21,12 +21,27 @@ type KimgConfig struct {
 		FormName  string            `yaml:"formName,omitempty"`
 		MaxSize   int64             `yaml:"maxSize,omitempty"`
 		EnableWeb bool              `yaml:"enableWeb,omitempty"`
+		SignKey   string            `yaml:"signKey,omitempty"`
+		SignOnly  bool              `yaml:"signOnly,omitempty"`
+		AdminKey  string            `yaml:"adminKey,omitempty"`
 	} `yaml:"httpd,omitempty"`
 
 	Image struct {
 		Format       string   `yaml:"format,omitempty"`
 		Quality      int      `yaml:"quality,omitempty"`
 		AllowedTypes []string `yaml:"allowedTypes,omitempty"`
+		ColorSpace   string   `yaml:"colorSpace,omitempty"`
+		Strip        struct {
+			Policy string   `yaml:"policy,omitempty"`
+			Keep   []string `yaml:"keep,omitempty"`
+		} `yaml:"strip,omitempty"`
+		Srcset struct {
+			Widths []int `yaml:"widths,omitempty"`
+		} `yaml:"srcset,omitempty"`
+		LQIP struct {
+			Width   int `yaml:"width,omitempty"`
+			Quality int `yaml:"quality,omitempty"`
+		} `yaml:"lqip,omitempty"`
 	} `yaml:"image,omitempty"`
 
 	Logger struct {
@@ -38,15 +53,58 @@ type KimgConfig struct {
 	Cache struct {
 		Mode     string `yaml:"mode,omitempty"`
 		MaxSize  int    `yaml:"maxSize,omitempty"`
+		Prefix   string `yaml:"prefix,omitempty"`
 		Memcache struct {
 			URL string `yaml:"url,omitempty"`
 		} `yaml:"memcache,omitempty"`
 		Redis struct {
-			URL string `yaml:"url,omitempty"`
+			URL  string `yaml:"url,omitempty"`
+			Pool struct {
+				MaxIdle     int `yaml:"maxIdle,omitempty"`
+				MaxActive   int `yaml:"maxActive,omitempty"`
+				IdleTimeout int `yaml:"idleTimeout,omitempty"`
+			} `yaml:"pool,omitempty"`
+			Timeout struct {
+				Connect int `yaml:"connect,omitempty"`
+				Read    int `yaml:"read,omitempty"`
+				Write   int `yaml:"write,omitempty"`
+			} `yaml:"timeout,omitempty"`
+			Sentinel struct {
+				Addrs    []string `yaml:"addrs,omitempty"`
+				Master   string   `yaml:"master,omitempty"`
+				Password string   `yaml:"password,omitempty"`
+			} `yaml:"sentinel,omitempty"`
+			Cluster struct {
+				Addrs []string `yaml:"addrs,omitempty"`
+			} `yaml:"cluster,omitempty"`
 		} `yaml:"redis,omitempty"`
 		Memory struct {
 			Capacity int64 `yaml:"capacity,omitempty"`
 		} `yaml:"memory,omitempty"`
+		Disk struct {
+			Root     string `yaml:"root,omitempty"`
+			Capacity int64  `yaml:"capacity,omitempty"`
+		} `yaml:"disk,omitempty"`
+		Tiered struct {
+			L2      string `yaml:"l2,omitempty"`
+			L1TTL   int    `yaml:"l1TTL,omitempty"`
+			Channel string `yaml:"channel,omitempty"`
+		} `yaml:"tiered,omitempty"`
+		TTL struct {
+			Origin     int `yaml:"origin,omitempty"`
+			Derivative int `yaml:"derivative,omitempty"`
+		} `yaml:"ttl,omitempty"`
+		Negative struct {
+			Enable bool `yaml:"enable,omitempty"`
+			TTL    int  `yaml:"ttl,omitempty"`
+			Size   int  `yaml:"size,omitempty"`
+			Bloom  struct {
+				Enable        bool    `yaml:"enable,omitempty"`
+				Capacity      int     `yaml:"capacity,omitempty"`
+				FalsePositive float64 `yaml:"falsePositive,omitempty"`
+				Refresh       int     `yaml:"refresh,omitempty"`
+			} `yaml:"bloom,omitempty"`
+		} `yaml:"negative,omitempty"`
 	} `yaml:"cache,omitempty"`
 
 	Storage struct {
@@ -64,29 +122,65 @@ type KimgConfig struct {
 		} `yaml:"minio,omitempty"`
 	} `yaml:"storage,omitempty"`
 
+	Similar struct {
+		Enable            bool   `yaml:"enable,omitempty"`
+		Distance          int    `yaml:"distance,omitempty"`
+		Duplicate         string `yaml:"duplicate,omitempty"`
+		DuplicateDistance int    `yaml:"duplicateDistance,omitempty"`
+	} `yaml:"similar,omitempty"`
+
+	Eager struct {
+		Enable  bool              `yaml:"enable,omitempty"`
+		Sync    bool              `yaml:"sync,omitempty"`
+		Queue   int               `yaml:"queue,omitempty"`
+		Workers int               `yaml:"workers,omitempty"`
+		Presets map[string]string `yaml:"presets,omitempty"`
+	} `yaml:"eager,omitempty"`
+
 	Watermark struct {
-		Enable  bool   `yaml:"enable,omitempty"`
-		Gravity string `yaml:"gravity,omitempty"`
-		X       int    `yaml:"x,omitempty"`
-		Y       int    `yaml:"y,omitempty"`
-		Rotate  int    `yaml:"rotate,omitempty"`
-		Opacity int    `yaml:"opacity,omitempty"`
-
-		Text struct {
-			Content     string `yaml:"content,omitempty"`
-			FontName    string `yaml:"fontName,omitempty"`
-			FontSize    int    `yaml:"fontSize,omitempty"`
-			FontColor   string `yaml:"fontColor,omitempty"`
-			StrokeColor string `yaml:"strokeColor,omitempty"`
-			StrokeWidth int    `yaml:"strokeWidth,omitempty"`
-		} `yaml:"text,omitempty"`
-
-		Logo struct {
-			File string `yaml:"file,omitempty"`
-			W    int    `yaml:"w,omitempty"`
-			H    int    `yaml:"h,omitempty"`
-		} `yaml:"logo,omitempty"`
+		Enable        bool `yaml:"enable,omitempty"`
+		KimgWatermark `yaml:",inline"`
+
+		Profiles map[string]*KimgWatermark `yaml:"profiles,omitempty"`
 	} `yaml:"watermark,omitempty"`
+
+	Mark struct {
+		Enable   bool   `yaml:"enable,omitempty"`
+		Key      string `yaml:"key,omitempty"`
+		Strength int    `yaml:"strength,omitempty"`
+	} `yaml:"mark,omitempty"`
+}
+
+// KimgWatermark is configuration of a watermark profile.
+type KimgWatermark struct {
+	Gravity string `yaml:"gravity,omitempty"`
+	X       int    `yaml:"x,omitempty"`
+	Y       int    `yaml:"y,omitempty"`
+	Rotate  int    `yaml:"rotate,omitempty"`
+	Opacity int    `yaml:"opacity,omitempty"`
+
+	Text struct {
+		Content     string `yaml:"content,omitempty"`
+		FontName    string `yaml:"fontName,omitempty"`
+		FontSize    int    `yaml:"fontSize,omitempty"`
+		FontColor   string `yaml:"fontColor,omitempty"`
+		StrokeColor string `yaml:"strokeColor,omitempty"`
+		StrokeWidth int    `yaml:"strokeWidth,omitempty"`
+	} `yaml:"text,omitempty"`
+
+	Tile struct {
+		Enable  bool `yaml:"enable,omitempty"`
+		Spacing int  `yaml:"spacing,omitempty"`
+		Angle   int  `yaml:"angle,omitempty"`
+	} `yaml:"tile,omitempty"`
+
+	Logo struct {
+		File  string `yaml:"file,omitempty"`
+		Md5   string `yaml:"md5,omitempty"`
+		W     int    `yaml:"w,omitempty"`
+		H     int    `yaml:"h,omitempty"`
+		Scale int    `yaml:"scale,omitempty"`
+	} `yaml:"logo,omitempty"`
 }
 
 // NewKimgConfig create a config instance from config file.
@@ -105,6 +199,12 @@ func NewKimgConfig(configFile string) (*KimgConfig, error) {
 	cfg.Image.Format = "jpeg"
 	cfg.Image.Quality = 75
 	cfg.Image.AllowedTypes = []string{"jpeg", "jpg", "png", "gif", "webp"}
+	cfg.Image.ColorSpace = "srgb"
+	cfg.Image.Strip.Policy = "all"
+	cfg.Image.Strip.Keep = []string{"Artist", "Copyright"}
+	cfg.Image.Srcset.Widths = []int{320, 640, 960, 1280, 1920}
+	cfg.Image.LQIP.Width = 32
+	cfg.Image.LQIP.Quality = 30
 
 	cfg.Logger.Mode = "console"
 	cfg.Logger.Level = "debug"
@@ -112,14 +212,45 @@ func NewKimgConfig(configFile string) (*KimgConfig, error) {
 
 	cfg.Cache.Mode = "memory"
 	cfg.Cache.MaxSize = 1 * 1024 * 1024
+	cfg.Cache.Prefix = "kimg:"
 	cfg.Cache.Memcache.URL = "127.0.0.1:11211"
 	cfg.Cache.Redis.URL = "127.0.0.1:6379"
+	cfg.Cache.Redis.Pool.MaxIdle = 3
+	cfg.Cache.Redis.Pool.IdleTimeout = 240
+	cfg.Cache.Redis.Timeout.Connect = 5000
+	cfg.Cache.Redis.Timeout.Read = 3000
+	cfg.Cache.Redis.Timeout.Write = 3000
 	cfg.Cache.Memory.Capacity = 100 * 1024 * 1024
+	cfg.Cache.Disk.Root = "cache"
+	cfg.Cache.Disk.Capacity = 1024 * 1024 * 1024
+	cfg.Cache.Tiered.L2 = "redis"
+	cfg.Cache.Tiered.L1TTL = 300
+	cfg.Cache.Tiered.Channel = "kimg:invalidate"
+	cfg.Cache.TTL.Origin = 7 * 24 * 3600
+	cfg.Cache.TTL.Derivative = 24 * 3600
+	cfg.Cache.Negative.Enable = false
+	cfg.Cache.Negative.TTL = 60
+	cfg.Cache.Negative.Size = 100000
+	cfg.Cache.Negative.Bloom.Capacity = 1000000
+	cfg.Cache.Negative.Bloom.FalsePositive = 0.01
+	cfg.Cache.Negative.Bloom.Refresh = 600
 
 	cfg.Storage.Mode = "file"
 	cfg.Storage.SaveNew = true
 	cfg.Storage.File.Root = "kimgs"
 
+	cfg.Similar.Enable = false
+	cfg.Similar.Distance = 10
+	cfg.Similar.Duplicate = "none"
+	cfg.Similar.DuplicateDistance = 4
+
+	cfg.Eager.Queue = 1000
+	cfg.Eager.Workers = 2
+	cfg.Eager.Presets = map[string]string{}
+
+	cfg.Mark.Key = "kimg"
+	cfg.Mark.Strength = 16
+
 	data, err := ioutil.ReadFile(configFile)
 	if err != nil {
 		log.Printf("[WARN] %s\n", err)
@@ -163,6 +294,15 @@ func NewKimgConfig(configFile string) (*KimgConfig, error) {
 	if env, ok := os.LookupEnv("KIMG_HTTPD_ENABLE_WEB"); ok {
 		cfg.Httpd.EnableWeb, _ = strconv.ParseBool(env)
 	}
+	if env, ok := os.LookupEnv("KIMG_HTTPD_SIGN_KEY"); ok {
+		cfg.Httpd.SignKey = env
+	}
+	if env, ok := os.LookupEnv("KIMG_HTTPD_SIGN_ONLY"); ok {
+		cfg.Httpd.SignOnly, _ = strconv.ParseBool(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_HTTPD_ADMIN_KEY"); ok {
+		cfg.Httpd.AdminKey = env
+	}
 
 	// image env
 	if env, ok := os.LookupEnv("KIMG_IMAGE_FORMAT"); ok {
@@ -174,6 +314,29 @@ func NewKimgConfig(configFile string) (*KimgConfig, error) {
 	if env, ok := os.LookupEnv("KIMG_IMAGE_ALLOWED_TYPES"); ok {
 		cfg.Image.AllowedTypes = strings.Split(env, ",")
 	}
+	if env, ok := os.LookupEnv("KIMG_IMAGE_COLOR_SPACE"); ok {
+		cfg.Image.ColorSpace = env
+	}
+	if env, ok := os.LookupEnv("KIMG_IMAGE_SRCSET_WIDTHS"); ok {
+		cfg.Image.Srcset.Widths = cfg.Image.Srcset.Widths[:0]
+		for _, v := range strings.Split(env, ",") {
+			if w, err := strconv.Atoi(v); err == nil && w > 0 {
+				cfg.Image.Srcset.Widths = append(cfg.Image.Srcset.Widths, w)
+			}
+		}
+	}
+	if env, ok := os.LookupEnv("KIMG_IMAGE_STRIP_POLICY"); ok {
+		cfg.Image.Strip.Policy = env
+	}
+	if env, ok := os.LookupEnv("KIMG_IMAGE_STRIP_KEEP"); ok {
+		cfg.Image.Strip.Keep = strings.Split(env, ",")
+	}
+	if env, ok := os.LookupEnv("KIMG_IMAGE_LQIP_WIDTH"); ok {
+		cfg.Image.LQIP.Width, _ = strconv.Atoi(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_IMAGE_LQIP_QUALITY"); ok {
+		cfg.Image.LQIP.Quality, _ = strconv.Atoi(env)
+	}
 
 	// logger env
 	if env, ok := os.LookupEnv("KIMG_LOGGER_MODE"); ok {
@@ -193,15 +356,90 @@ func NewKimgConfig(configFile string) (*KimgConfig, error) {
 	if env, ok := os.LookupEnv("KIMG_CACHE_MAX_SIZE"); ok {
 		cfg.Cache.MaxSize, _ = strconv.Atoi(env)
 	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_PREFIX"); ok {
+		cfg.Cache.Prefix = env
+	}
 	if env, ok := os.LookupEnv("KIMG_CACHE_MEMCACHE_URL"); ok {
 		cfg.Cache.Memcache.URL = env
 	}
 	if env, ok := os.LookupEnv("KIMG_CACHE_REDIS_URL"); ok {
 		cfg.Cache.Redis.URL = env
 	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_REDIS_POOL_MAX_IDLE"); ok {
+		cfg.Cache.Redis.Pool.MaxIdle, _ = strconv.Atoi(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_REDIS_POOL_MAX_ACTIVE"); ok {
+		cfg.Cache.Redis.Pool.MaxActive, _ = strconv.Atoi(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_REDIS_POOL_IDLE_TIMEOUT"); ok {
+		cfg.Cache.Redis.Pool.IdleTimeout, _ = strconv.Atoi(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_REDIS_TIMEOUT_CONNECT"); ok {
+		cfg.Cache.Redis.Timeout.Connect, _ = strconv.Atoi(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_REDIS_TIMEOUT_READ"); ok {
+		cfg.Cache.Redis.Timeout.Read, _ = strconv.Atoi(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_REDIS_TIMEOUT_WRITE"); ok {
+		cfg.Cache.Redis.Timeout.Write, _ = strconv.Atoi(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_REDIS_SENTINEL_ADDRS"); ok {
+		cfg.Cache.Redis.Sentinel.Addrs = strings.Split(env, ",")
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_REDIS_SENTINEL_MASTER"); ok {
+		cfg.Cache.Redis.Sentinel.Master = env
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_REDIS_SENTINEL_PASSWORD"); ok {
+		cfg.Cache.Redis.Sentinel.Password = env
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_REDIS_CLUSTER_ADDRS"); ok {
+		cfg.Cache.Redis.Cluster.Addrs = strings.Split(env, ",")
+	}
 	if env, ok := os.LookupEnv("KIMG_CACHE_MEMORY_CAPACITY"); ok {
 		cfg.Cache.Memory.Capacity, _ = strconv.ParseInt(env, 0, 64)
 	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_DISK_ROOT"); ok {
+		cfg.Cache.Disk.Root = env
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_DISK_CAPACITY"); ok {
+		cfg.Cache.Disk.Capacity, _ = strconv.ParseInt(env, 0, 64)
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_TIERED_L2"); ok {
+		cfg.Cache.Tiered.L2 = env
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_TIERED_L1_TTL"); ok {
+		cfg.Cache.Tiered.L1TTL, _ = strconv.Atoi(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_TIERED_CHANNEL"); ok {
+		cfg.Cache.Tiered.Channel = env
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_TTL_ORIGIN"); ok {
+		cfg.Cache.TTL.Origin, _ = strconv.Atoi(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_TTL_DERIVATIVE"); ok {
+		cfg.Cache.TTL.Derivative, _ = strconv.Atoi(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_NEGATIVE_ENABLE"); ok {
+		cfg.Cache.Negative.Enable, _ = strconv.ParseBool(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_NEGATIVE_TTL"); ok {
+		cfg.Cache.Negative.TTL, _ = strconv.Atoi(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_NEGATIVE_SIZE"); ok {
+		cfg.Cache.Negative.Size, _ = strconv.Atoi(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_NEGATIVE_BLOOM_ENABLE"); ok {
+		cfg.Cache.Negative.Bloom.Enable, _ = strconv.ParseBool(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_NEGATIVE_BLOOM_CAPACITY"); ok {
+		cfg.Cache.Negative.Bloom.Capacity, _ = strconv.Atoi(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_NEGATIVE_BLOOM_FALSE_POSITIVE"); ok {
+		cfg.Cache.Negative.Bloom.FalsePositive, _ = strconv.ParseFloat(env, 64)
+	}
+	if env, ok := os.LookupEnv("KIMG_CACHE_NEGATIVE_BLOOM_REFRESH"); ok {
+		cfg.Cache.Negative.Bloom.Refresh, _ = strconv.Atoi(env)
+	}
 
 	// storage env
 	if env, ok := os.LookupEnv("KIMG_STORAGE_MODE"); ok {
@@ -229,6 +467,46 @@ func NewKimgConfig(configFile string) (*KimgConfig, error) {
 		cfg.Storage.Minio.UseSSL, _ = strconv.ParseBool(env)
 	}
 
+	// similar env
+	if env, ok := os.LookupEnv("KIMG_SIMILAR_ENABLE"); ok {
+		cfg.Similar.Enable, _ = strconv.ParseBool(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_SIMILAR_DISTANCE"); ok {
+		cfg.Similar.Distance, _ = strconv.Atoi(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_SIMILAR_DUPLICATE"); ok {
+		cfg.Similar.Duplicate = env
+	}
+	if env, ok := os.LookupEnv("KIMG_SIMILAR_DUPLICATE_DISTANCE"); ok {
+		cfg.Similar.DuplicateDistance, _ = strconv.Atoi(env)
+	}
+
+	// eager env
+	if env, ok := os.LookupEnv("KIMG_EAGER_ENABLE"); ok {
+		cfg.Eager.Enable, _ = strconv.ParseBool(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_EAGER_SYNC"); ok {
+		cfg.Eager.Sync, _ = strconv.ParseBool(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_EAGER_QUEUE"); ok {
+		cfg.Eager.Queue, _ = strconv.Atoi(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_EAGER_WORKERS"); ok {
+		cfg.Eager.Workers, _ = strconv.Atoi(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_EAGER_PRESETS"); ok {
+		if cfg.Eager.Presets == nil {
+			cfg.Eager.Presets = make(map[string]string)
+		}
+		arr := strings.Split(env, ",")
+		for _, v := range arr {
+			s := strings.SplitN(v, ":", 2)
+			if len(s) == 2 {
+				cfg.Eager.Presets[s[0]] = s[1]
+			}
+		}
+	}
+
 	// watermark env
 	if env, ok := os.LookupEnv("KIMG_WATERMARK_ENABLE"); ok {
 		cfg.Watermark.Enable, _ = strconv.ParseBool(env)
@@ -248,6 +526,15 @@ func NewKimgConfig(configFile string) (*KimgConfig, error) {
 	if env, ok := os.LookupEnv("KIMG_WATERMARK_OPACITY"); ok {
 		cfg.Watermark.Opacity, _ = strconv.Atoi(env)
 	}
+	if env, ok := os.LookupEnv("KIMG_WATERMARK_TILE_ENABLE"); ok {
+		cfg.Watermark.Tile.Enable, _ = strconv.ParseBool(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_WATERMARK_TILE_SPACING"); ok {
+		cfg.Watermark.Tile.Spacing, _ = strconv.Atoi(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_WATERMARK_TILE_ANGLE"); ok {
+		cfg.Watermark.Tile.Angle, _ = strconv.Atoi(env)
+	}
 	if env, ok := os.LookupEnv("KIMG_WATERMARK_TEXT_CONTENT"); ok {
 		cfg.Watermark.Text.Content = env
 	}
@@ -269,12 +556,29 @@ func NewKimgConfig(configFile string) (*KimgConfig, error) {
 	if env, ok := os.LookupEnv("KIMG_WATERMARK_LOGO_FILE"); ok {
 		cfg.Watermark.Logo.File = env
 	}
+	if env, ok := os.LookupEnv("KIMG_WATERMARK_LOGO_MD5"); ok {
+		cfg.Watermark.Logo.Md5 = env
+	}
 	if env, ok := os.LookupEnv("KIMG_WATERMARK_LOGO_W"); ok {
 		cfg.Watermark.Logo.W, _ = strconv.Atoi(env)
 	}
 	if env, ok := os.LookupEnv("KIMG_WATERMARK_LOGO_H"); ok {
 		cfg.Watermark.Logo.H, _ = strconv.Atoi(env)
 	}
+	if env, ok := os.LookupEnv("KIMG_WATERMARK_LOGO_SCALE"); ok {
+		cfg.Watermark.Logo.Scale, _ = strconv.Atoi(env)
+	}
+
+	// invisible watermark env
+	if env, ok := os.LookupEnv("KIMG_MARK_ENABLE"); ok {
+		cfg.Mark.Enable, _ = strconv.ParseBool(env)
+	}
+	if env, ok := os.LookupEnv("KIMG_MARK_KEY"); ok {
+		cfg.Mark.Key = env
+	}
+	if env, ok := os.LookupEnv("KIMG_MARK_STRENGTH"); ok {
+		cfg.Mark.Strength, _ = strconv.Atoi(env)
+	}
 
 	return &cfg, nil
 }
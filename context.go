@@ -4,9 +4,21 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// ErrDuplicateImage returned when a uploaded image is rejected as near-duplicate.
+var ErrDuplicateImage = errors.New("duplicate image")
+
+// ErrCacheDisabled returned by cache management when cache disabled.
+var ErrCacheDisabled = errors.New("cache disabled")
+
 // KimgRequest define a image request.
 type KimgRequest struct {
 	Md5    string `json:"-"`
@@ -14,6 +26,16 @@ type KimgRequest struct {
 	Style  string `json:"-"`
 	Save   bool   `json:"-"`
 
+	// info params
+	Placeholder bool `json:"-"`
+	Palette     int  `json:"-"`
+	TrimBox     bool `json:"-"`
+
+	// trim params
+	Trim     bool `json:"trim,omitempty"`
+	TrimFuzz int  `json:"trim_fuzz,omitempty"`
+	TrimPad  int  `json:"trim_pad,omitempty"`
+
 	// scale params
 	Scale   bool   `json:"scale,omitempty"`
 	ScaleM  string `json:"scale_m,omitempty"`
@@ -24,21 +46,69 @@ type KimgRequest struct {
 	ScaleP  int    `json:"scale_p,omitempty"`
 
 	// crop params
-	Crop    bool   `json:"crop,omitempty"`
-	Gravity string `json:"gravity,omitempty"`
-	CropW   int    `json:"crop_w,omitempty"`
-	CropH   int    `json:"crop_h,omitempty"`
-	Offset  string `json:"offset,omitempty"`
-	OffsetX int    `json:"offset_x,omitempty"`
-	OffsetY int    `json:"offset_y,omitempty"`
-
-	Format     string `json:"format,omitempty"`
-	Quality    int    `json:"quality,omitempty"`
-	Rotate     int    `json:"rotate,omitempty"`
-	BGColor    string `json:"bg_color,omitempty"`
-	Gray       bool   `json:"gray,omitempty"`
-	AutoOrient bool   `json:"auto_orient,omitempty"`
-	Strip      bool   `json:"strip,omitempty"`
+	Crop    bool    `json:"crop,omitempty"`
+	Gravity string  `json:"gravity,omitempty"`
+	Focal   bool    `json:"focal,omitempty"`
+	FocalX  float64 `json:"fx,omitempty"`
+	FocalY  float64 `json:"fy,omitempty"`
+	CropW   int     `json:"crop_w,omitempty"`
+	CropH   int     `json:"crop_h,omitempty"`
+	Offset  string  `json:"offset,omitempty"`
+	OffsetX int     `json:"offset_x,omitempty"`
+	OffsetY int     `json:"offset_y,omitempty"`
+
+	// adjust params
+	Normalize  bool    `json:"normalize,omitempty"`
+	AutoLevel  bool    `json:"auto_level,omitempty"`
+	Brightness int     `json:"brightness,omitempty"`
+	Contrast   int     `json:"contrast,omitempty"`
+	Saturation int     `json:"saturation,omitempty"`
+	Hue        int     `json:"hue,omitempty"`
+	Gamma      float64 `json:"gamma,omitempty"`
+	Blur       float64 `json:"blur,omitempty"`
+	Sharpen    float64 `json:"sharpen,omitempty"`
+	Sepia      int     `json:"sepia,omitempty"`
+	Negate     bool    `json:"negate,omitempty"`
+
+	// decorate params
+	Pad         bool   `json:"pad,omitempty"`
+	PadW        int    `json:"pad_w,omitempty"`
+	PadH        int    `json:"pad_h,omitempty"`
+	BorderW     int    `json:"border_w,omitempty"`
+	BorderColor string `json:"border_color,omitempty"`
+	Radius      int    `json:"radius,omitempty"`
+	Circle      bool   `json:"circle,omitempty"`
+
+	// watermark params
+	Watermark        string `json:"watermark,omitempty"`
+	WatermarkText    string `json:"watermark_text,omitempty"`
+	WatermarkSize    int    `json:"watermark_size,omitempty"`
+	WatermarkColor   string `json:"watermark_color,omitempty"`
+	WatermarkGravity string `json:"watermark_gravity,omitempty"`
+	Mark             string `json:"mark,omitempty"`
+
+	Format      string  `json:"format,omitempty"`
+	Quality     int     `json:"quality,omitempty"`
+	Flip        bool    `json:"flip,omitempty"`
+	Flop        bool    `json:"flop,omitempty"`
+	Rotate      float64 `json:"rotate,omitempty"`
+	RotateM     string  `json:"rotate_m,omitempty"`
+	BGColor     string  `json:"bg_color,omitempty"`
+	Gray        bool    `json:"gray,omitempty"`
+	AutoOrient  bool    `json:"auto_orient,omitempty"`
+	Strip       bool    `json:"strip,omitempty"`
+	StripPolicy string  `json:"strip_policy,omitempty"`
+	ColorSpace  string  `json:"color_space,omitempty"`
+	KeepICC     bool    `json:"keep_icc,omitempty"`
+	LQIP        bool    `json:"lqip,omitempty"`
+
+	// crop window found by smart gravity on the first frame, shared by all frames of animation.
+	smartWindow *kimgSmartWindow
+}
+
+type kimgSmartWindow struct {
+	x, y  int
+	found bool
 }
 
 // KimgResponse define a image response.
@@ -52,15 +122,182 @@ type KimgResponse struct {
 	Format      string            `json:"format"`
 	Orientation string            `json:"orientation"`
 	Exif        map[string]string `json:"exif"`
+	ColorSpace  string            `json:"color_space"`
+	ICCProfile  string            `json:"icc_profile,omitempty"`
+	IPTC        map[string]string `json:"iptc,omitempty"`
+	XMP         map[string]string `json:"xmp,omitempty"`
+	GPS         *KimgGPS          `json:"gps,omitempty"`
+	BlurHash    string            `json:"blurhash,omitempty"`
+	ThumbHash   string            `json:"thumbhash,omitempty"`
+	PHash       string            `json:"phash,omitempty"`
+	DuplicateOf string            `json:"duplicate_of,omitempty"`
+	Palette     *KimgPalette      `json:"palette,omitempty"`
+	Trim        *KimgTrimBox      `json:"trim,omitempty"`
+	Meta        *KimgMeta         `json:"meta,omitempty"`
+	Derivatives map[string]string `json:"derivatives,omitempty"`
+}
+
+// KimgPalette define the color palette of a image.
+type KimgPalette struct {
+	Dominant    string              `json:"dominant"`
+	Average     string              `json:"average"`
+	Transparent bool                `json:"transparent"`
+	Colors      []*KimgPaletteColor `json:"colors"`
+}
+
+// KimgPaletteColor define a color and its pixel proportion in palette.
+type KimgPaletteColor struct {
+	Color      string  `json:"color"`
+	Proportion float64 `json:"proportion"`
+}
+
+// KimgTrimBox define the box left after trimming uniform borders of a image.
+type KimgTrimBox struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// KimgGPS define the location decoded from exif GPS.
+type KimgGPS struct {
+	Latitude  float64  `json:"lat"`
+	Longitude float64  `json:"lon"`
+	Altitude  *float64 `json:"alt,omitempty"`
+}
+
+// KimgMeta define user metadata attached to a image.
+type KimgMeta struct {
+	Alt    string   `json:"alt,omitempty"`
+	Owner  string   `json:"owner,omitempty"`
+	Source string   `json:"source,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+
+	// focal point as fractions of image width and height.
+	FX *float64 `json:"fx,omitempty"`
+	FY *float64 `json:"fy,omitempty"`
+
+	// perceptual hash kept by similar index, it is not replaced by users.
+	PHash string `json:"phash,omitempty"`
+}
+
+// ValidFocal check whether the focal point is unset, or both fx and fy are fractions in [0, 1].
+func (meta *KimgMeta) ValidFocal() bool {
+	if meta.FX == nil && meta.FY == nil {
+		return true
+	}
+	return meta.FX != nil && meta.FY != nil && *meta.FX >= 0 && *meta.FX <= 1 && *meta.FY >= 0 && *meta.FY <= 1
+}
+
+// HasTags check whether the metadata contains all the tags.
+func (meta *KimgMeta) HasTags(tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range meta.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// KimgSaveOptions define options of saving a image.
+type KimgSaveOptions struct {
+	// Duplicate near-duplicate upload policy, maybe "none", "reject" or "link".
+	Duplicate string
+	// Eager render presets after upload, maybe "", "sync" or "async".
+	Eager string
+}
+
+// KimgSimilarResponse define a near-duplicate search response.
+type KimgSimilarResponse struct {
+	Md5     string         `json:"md5"`
+	PHash   string         `json:"phash"`
+	Similar []*KimgSimilar `json:"similar"`
+}
+
+// KimgMarkResponse define a invisible watermark detection response.
+type KimgMarkResponse struct {
+	Found      bool    `json:"found"`
+	Payload    string  `json:"payload,omitempty"`
+	Confidence float64 `json:"confidence"`
+}
+
+// KimgCachePurgeResponse define a cache purge response.
+type KimgCachePurgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+// KimgSrcsetRequest define a responsive srcset request.
+type KimgSrcsetRequest struct {
+	Md5       string
+	Widths    []int
+	Formats   []string
+	Query     url.Values
+	Sign      bool
+	Prerender bool
+}
+
+// KimgSrcsetVariant define a image variant of srcset.
+type KimgSrcsetVariant struct {
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	URL    string `json:"url"`
+}
+
+// KimgSrcsetResponse define a responsive srcset response.
+type KimgSrcsetResponse struct {
+	Md5      string               `json:"md5"`
+	Width    int                  `json:"width"`
+	Height   int                  `json:"height"`
+	Srcset   map[string]string    `json:"srcset"`
+	Variants []*KimgSrcsetVariant `json:"variants"`
+}
+
+// KimgListRequest define a image list request.
+type KimgListRequest struct {
+	Cursor string
+	Limit  int
+	Format string
+	Tags   []string
+	From   time.Time
+	To     time.Time
+	// Info decode each image for format, width and height, it is implied by format filter.
+	Info bool
+}
+
+// KimgListItem define a image item in list response.
+type KimgListItem struct {
+	Md5     string    `json:"md5"`
+	URL     string    `json:"url"`
+	Size    int       `json:"size"`
+	Created time.Time `json:"created"`
+	Format  string    `json:"format,omitempty"`
+	Width   int       `json:"width,omitempty"`
+	Height  int       `json:"height,omitempty"`
+}
+
+// KimgListResponse define a image list response.
+type KimgListResponse struct {
+	Images []*KimgListItem `json:"images"`
+	Cursor string          `json:"cursor,omitempty"`
 }
 
 // KimgContext context of kimg.
 type KimgContext struct {
-	Config  *KimgConfig
-	Cache   KimgCache
-	Logger  KimgLogger
-	Storage KimgStorage
-	Image   *KimgImagick
+	Config   *KimgConfig
+	Cache    KimgCache
+	Logger   KimgLogger
+	Storage  KimgStorage
+	Image    *KimgImagick
+	PHash    *KimgPHashIndex
+	Eager    *KimgEagerQueue
+	Negative *KimgNegativeCache
 }
 
 // Key generate a key according to image style request params.
@@ -105,35 +342,85 @@ func NewKimgContext(configFile string) (*KimgContext, error) {
 	}
 	ctx.Storage = storage
 
+	if config.Cache.Negative.Enable {
+		ctx.Negative = NewKimgNegativeCache(&ctx)
+	}
+
 	ctx.Image = NewKimgImagick(&ctx)
 
+	if config.Similar.Enable {
+		ctx.PHash = NewKimgPHashIndex(&ctx)
+		go ctx.PHash.Load()
+	}
+
+	// eager queue renders presets after upload, and srcset variants to prerender.
+	ctx.Eager = NewKimgEagerQueue(&ctx, config.Eager.Queue, config.Eager.Workers)
+
 	logger.Info("%+v", config)
 	return &ctx, nil
 }
 
 // Release release resource in kimg context.
 func (ctx *KimgContext) Release() {
+	if ctx.Eager != nil {
+		ctx.Eager.Close()
+	}
+	if ctx.Negative != nil {
+		ctx.Negative.Close()
+	}
 	ctx.Image.Release()
 }
 
 // SaveImage save a image to kimg and make a kimg response.
-func (ctx *KimgContext) SaveImage(data []byte) (*KimgResponse, error) {
+func (ctx *KimgContext) SaveImage(data []byte, opts *KimgSaveOptions) (*KimgResponse, error) {
 	m := md5.New()
 	m.Write(data)
 	md5Sum := hex.EncodeToString(m.Sum(nil))
 
-	ctx.Logger.Debug("SaveImage md5Sum: %s", md5Sum)
+	ctx.Logger.Debug("SaveImage md5Sum: %s, opts: %#v", md5Sum, opts)
 
 	req := ctx.originRequest(md5Sum)
 
-	err := ctx.Storage.Set(req, data)
+	var hash uint64
+	var err error
+	if ctx.PHash != nil {
+		hash, err = ctx.Image.PHash(data)
+		if err != nil {
+			ctx.Logger.Warn("SaveImage md5Sum: %s, Image.PHash err: %s", md5Sum, err)
+			return nil, err
+		}
+
+		if opts.Duplicate == "reject" || opts.Duplicate == "link" {
+			for _, similar := range ctx.PHash.Search(hash, ctx.Config.Similar.DuplicateDistance) {
+				if similar.Md5 == md5Sum {
+					continue
+				}
+				resp, err := ctx.InfoImage(ctx.originRequest(similar.Md5))
+				if err != nil {
+					continue
+				}
+				resp.DuplicateOf = similar.Md5
+				ctx.Logger.Info("SaveImage md5Sum: %s, duplicate of %s, distance: %d", md5Sum, similar.Md5, similar.Distance)
+				if opts.Duplicate == "reject" {
+					return resp, ErrDuplicateImage
+				}
+				return resp, nil
+			}
+		}
+	}
+
+	err = ctx.Storage.Set(req, data)
 	if err != nil {
 		return nil, err
 	}
 
+	if ctx.Negative != nil {
+		ctx.Negative.Add(md5Sum)
+	}
+
 	if ctx.isCacheEnable(data) {
 		cacheKey := ctx.cacheKey(req)
-		if err = ctx.Cache.Set(cacheKey, data); err != nil {
+		if err = ctx.Cache.SetTTL(cacheKey, data, ctx.cacheTTL(req)); err != nil {
 			ctx.Logger.Warn("SaveImage md5Sum: %s, SetCache %s err: %s", md5Sum, cacheKey, err)
 		} else {
 			ctx.Logger.Debug("SaveImage md5Sum: %s, SetCache %s", md5Sum, cacheKey)
@@ -146,6 +433,21 @@ func (ctx *KimgContext) SaveImage(data []byte) (*KimgResponse, error) {
 		return nil, err
 	}
 
+	resp.BlurHash, resp.ThumbHash, err = ctx.Image.Placeholder(data)
+	if err != nil {
+		ctx.Logger.Warn("SaveImage md5Sum: %s, Image.Placeholder err: %s", md5Sum, err)
+	}
+
+	if ctx.PHash != nil {
+		if err := ctx.PHash.Set(md5Sum, hash); err == nil {
+			resp.PHash = formatPHash(hash)
+		}
+	}
+
+	if len(ctx.Config.Eager.Presets) > 0 && len(opts.Eager) > 0 {
+		resp.Derivatives = ctx.renderPresets(md5Sum, opts.Eager == "sync")
+	}
+
 	return resp, nil
 }
 
@@ -154,6 +456,7 @@ func (ctx *KimgContext) GetImage(req *KimgRequest) ([]byte, error) {
 
 	ctx.Logger.Debug("GetImage md5Sum: %s, req: %#v", req.Md5, req)
 
+	ctx.applyFocal(req)
 	cacheKey := ctx.cacheKey(req)
 
 	if ctx.isCacheEnable(nil) {
@@ -165,19 +468,24 @@ func (ctx *KimgContext) GetImage(req *KimgRequest) ([]byte, error) {
 		ctx.Logger.Debug("GetImage md5Sum: %s, GetCache %s err: %s", req.Md5, cacheKey, err)
 	}
 
-	data, err := ctx.Storage.Get(req)
-	if err == nil {
-		if ctx.isCacheEnable(data) {
-			if err = ctx.Cache.Set(cacheKey, data); err != nil {
-				ctx.Logger.Warn("GetImage md5Sum: %s, SetCache %s err: %s", req.Md5, cacheKey, err)
-			} else {
-				ctx.Logger.Debug("GetImage md5Sum: %s, SetCache %s", req.Md5, cacheKey)
+	// storage is skipped if image known missing, but origin may be found in cache shared with other instances.
+	missing := ctx.Negative != nil && ctx.Negative.Missing(req.Md5)
+	if !missing {
+		data, err := ctx.Storage.Get(req)
+		if err == nil {
+			if ctx.isCacheEnable(data) {
+				if err = ctx.Cache.SetTTL(cacheKey, data, ctx.cacheTTL(req)); err != nil {
+					ctx.Logger.Warn("GetImage md5Sum: %s, SetCache %s err: %s", req.Md5, cacheKey, err)
+				} else {
+					ctx.Logger.Debug("GetImage md5Sum: %s, SetCache %s", req.Md5, cacheKey)
+				}
 			}
+			return data, nil
 		}
-		return data, nil
 	}
 
 	var originData []byte
+	var err error
 	saveToCache := false
 	originReq := ctx.originRequest(req.Md5)
 	if ctx.isCacheEnable(nil) {
@@ -192,13 +500,24 @@ func (ctx *KimgContext) GetImage(req *KimgRequest) ([]byte, error) {
 	}
 
 	if originData == nil {
+		if missing {
+			ctx.Logger.Debug("GetImage md5Sum: %s, known missing", req.Md5)
+			return nil, ErrImageNotExist
+		}
 		originData, err = ctx.Storage.Get(originReq)
 		if err != nil {
-			ctx.Logger.Warn("GetImage md5Sum: %s, GetStorage err: %s", req.Md5, err)
+			if errors.Is(err, ErrImageNotExist) {
+				ctx.Logger.Debug("GetImage md5Sum: %s, GetStorage err: %s", req.Md5, err)
+				if ctx.Negative != nil {
+					ctx.Negative.SetMissing(req.Md5)
+				}
+			} else {
+				ctx.Logger.Warn("GetImage md5Sum: %s, GetStorage err: %s", req.Md5, err)
+			}
 			return nil, err
 		} else if ctx.isCacheEnable(originData) && saveToCache {
 			originCacheKey := ctx.cacheKey(originReq)
-			if err = ctx.Cache.Set(originCacheKey, originData); err != nil {
+			if err = ctx.Cache.SetTTL(originCacheKey, originData, ctx.cacheTTL(originReq)); err != nil {
 				ctx.Logger.Warn("GetImage md5Sum: %s, SetOriginCache %s err: %s", req.Md5, originCacheKey, err)
 			} else {
 				ctx.Logger.Debug("GetImage md5Sum: %s, SetOriginCache %s", req.Md5, originCacheKey)
@@ -206,14 +525,18 @@ func (ctx *KimgContext) GetImage(req *KimgRequest) ([]byte, error) {
 		}
 	}
 
-	data, err = ctx.Image.Convert(originData, *req)
+	if missing {
+		ctx.Negative.Add(req.Md5)
+	}
+
+	data, err := ctx.Image.Convert(originData, *req)
 	if err != nil {
 		ctx.Logger.Warn("GetImage md5Sum: %s, Image.Convert err: %s", req.Md5, err)
 		return nil, err
 	}
 
 	if ctx.isCacheEnable(nil) {
-		if err = ctx.Cache.Set(cacheKey, data); err != nil {
+		if err = ctx.Cache.SetTTL(cacheKey, data, ctx.cacheTTL(req)); err != nil {
 			ctx.Logger.Warn("GetImage md5Sum: %s, SetCache %s err: %s", req.Md5, cacheKey, err)
 		} else {
 			ctx.Logger.Debug("GetImage md5Sum: %s, SetCache %s", req.Md5, cacheKey)
@@ -249,12 +572,23 @@ func (ctx *KimgContext) InfoImage(req *KimgRequest) (*KimgResponse, error) {
 	}
 
 	if data == nil {
+		if ctx.Negative != nil && ctx.Negative.Missing(req.Md5) {
+			ctx.Logger.Debug("InfoImage md5Sum: %s, known missing", req.Md5)
+			return nil, ErrImageNotExist
+		}
 		data, err = ctx.Storage.Get(req)
 		if err != nil {
-			ctx.Logger.Warn("InfoImage md5Sum: %s, GetStorage err: %s", req.Md5, err)
+			if errors.Is(err, ErrImageNotExist) {
+				ctx.Logger.Debug("InfoImage md5Sum: %s, GetStorage err: %s", req.Md5, err)
+				if ctx.Negative != nil && req.Origin {
+					ctx.Negative.SetMissing(req.Md5)
+				}
+			} else {
+				ctx.Logger.Warn("InfoImage md5Sum: %s, GetStorage err: %s", req.Md5, err)
+			}
 			return nil, err
 		} else if ctx.isCacheEnable(data) && saveToCache {
-			if err = ctx.Cache.Set(cacheKey, data); err != nil {
+			if err = ctx.Cache.SetTTL(cacheKey, data, ctx.cacheTTL(req)); err != nil {
 				ctx.Logger.Warn("InfoImage md5Sum: %s, SetCache %s err: %s", req.Md5, cacheKey, err)
 			} else {
 				ctx.Logger.Debug("InfoImage md5Sum: %s, SetCache %s", req.Md5, cacheKey)
@@ -268,7 +602,82 @@ func (ctx *KimgContext) InfoImage(req *KimgRequest) (*KimgResponse, error) {
 		return nil, err
 	}
 
-	return resp, err
+	if req.Placeholder {
+		resp.BlurHash, resp.ThumbHash, err = ctx.Image.Placeholder(data)
+		if err != nil {
+			ctx.Logger.Warn("InfoImage md5Sum: %s, Image.Placeholder err: %s", req.Md5, err)
+		}
+	}
+
+	if req.Palette > 0 {
+		resp.Palette, err = ctx.Image.Palette(data, req.Palette)
+		if err != nil {
+			ctx.Logger.Warn("InfoImage md5Sum: %s, Image.Palette err: %s", req.Md5, err)
+		}
+	}
+
+	if req.TrimBox {
+		resp.Trim, err = ctx.Image.TrimBox(data, req.TrimFuzz)
+		if err != nil {
+			ctx.Logger.Warn("InfoImage md5Sum: %s, Image.TrimBox err: %s", req.Md5, err)
+		}
+	}
+
+	if ctx.PHash != nil {
+		if hash, err := ctx.PHash.Get(req.Md5); err == nil {
+			resp.PHash = formatPHash(hash)
+		}
+	}
+
+	meta, err := ctx.Storage.GetMeta(ctx.originRequest(req.Md5))
+	if err != nil {
+		ctx.Logger.Warn("InfoImage md5Sum: %s, GetMeta err: %s", req.Md5, err)
+	} else {
+		resp.Meta = meta
+	}
+
+	return resp, nil
+}
+
+// GetImageMeta get the user metadata of a image according the md5 key.
+func (ctx *KimgContext) GetImageMeta(md5Sum string) (*KimgMeta, error) {
+
+	ctx.Logger.Debug("GetImageMeta md5Sum: %s", md5Sum)
+
+	meta, err := ctx.Storage.GetMeta(ctx.originRequest(md5Sum))
+	if err != nil {
+		ctx.Logger.Warn("GetImageMeta md5Sum: %s, GetMeta err: %s", md5Sum, err)
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+// SetImageMeta replace the user metadata of a image according the md5 key.
+func (ctx *KimgContext) SetImageMeta(md5Sum string, meta *KimgMeta) error {
+
+	ctx.Logger.Debug("SetImageMeta md5Sum: %s, meta: %#v", md5Sum, meta)
+
+	if !meta.ValidFocal() {
+		return errors.New("invalid focal point")
+	}
+
+	meta.PHash = ""
+	if old, err := ctx.Storage.GetMeta(ctx.originRequest(md5Sum)); err == nil {
+		meta.PHash = old.PHash
+	}
+
+	err := ctx.Storage.SetMeta(ctx.originRequest(md5Sum), meta)
+	if err != nil {
+		ctx.Logger.Warn("SetImageMeta md5Sum: %s, SetMeta err: %s", md5Sum, err)
+		return err
+	}
+
+	if ctx.isCacheEnable(nil) {
+		ctx.Cache.Del(focalCacheKey(md5Sum))
+	}
+
+	return nil
 }
 
 // DeleteImage delete a image from kimg according the md5 key.
@@ -286,6 +695,13 @@ func (ctx *KimgContext) DeleteImage(md5Sum string) error {
 		} else {
 			ctx.Logger.Debug("DeleteImage md5Sum: %s, DelCache %s", req.Md5, cacheKey)
 		}
+
+		// derivatives and focal point, the tiered cache invalidates them in all instances.
+		if n, err := ctx.Cache.DelPrefix(req.Md5 + ":"); err != nil {
+			ctx.Logger.Warn("DeleteImage md5Sum: %s, DelPrefixCache err: %s", req.Md5, err)
+		} else {
+			ctx.Logger.Debug("DeleteImage md5Sum: %s, DelPrefixCache %d", req.Md5, n)
+		}
 	}
 
 	err := ctx.Storage.Del(req)
@@ -294,13 +710,344 @@ func (ctx *KimgContext) DeleteImage(md5Sum string) error {
 		return err
 	}
 
+	if ctx.PHash != nil {
+		ctx.PHash.Del(md5Sum)
+	}
+
+	ctx.Image.DropLogo("md5:" + md5Sum)
+
+	return nil
+}
+
+// CacheStats get the statistics of kimg cache.
+func (ctx *KimgContext) CacheStats() (*KimgCacheStats, error) {
+	if ctx.Cache == nil {
+		return nil, ErrCacheDisabled
+	}
+
+	ctx.Logger.Debug("CacheStats")
+
+	stats, err := ctx.Cache.Stats()
+	if err != nil {
+		ctx.Logger.Warn("CacheStats err: %s", err)
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// PurgeCache delete a key from kimg cache, it returns the number of keys deleted.
+func (ctx *KimgContext) PurgeCache(key string) (*KimgCachePurgeResponse, error) {
+	if ctx.Cache == nil {
+		return nil, ErrCacheDisabled
+	}
+
+	ctx.Logger.Debug("PurgeCache key: %s", key)
+
+	resp := &KimgCachePurgeResponse{}
+	if err := ctx.Cache.Del(key); err != nil {
+		ctx.Logger.Debug("PurgeCache key: %s, DelCache err: %s", key, err)
+	} else {
+		resp.Purged = 1
+	}
+
+	return resp, nil
+}
+
+// PurgeImageCache delete all cached derivatives of a image from kimg cache, the origin image is kept.
+func (ctx *KimgContext) PurgeImageCache(md5Sum string) (*KimgCachePurgeResponse, error) {
+	if ctx.Cache == nil {
+		return nil, ErrCacheDisabled
+	}
+
+	ctx.Logger.Debug("PurgeImageCache md5Sum: %s", md5Sum)
+
+	n, err := ctx.Cache.DelPrefix(md5Sum + ":")
+	if err != nil {
+		ctx.Logger.Warn("PurgeImageCache md5Sum: %s, DelPrefix err: %s", md5Sum, err)
+		return nil, err
+	}
+
+	return &KimgCachePurgeResponse{Purged: n}, nil
+}
+
+// FlushCache delete all from kimg cache.
+func (ctx *KimgContext) FlushCache() error {
+	if ctx.Cache == nil {
+		return ErrCacheDisabled
+	}
+
+	ctx.Logger.Debug("FlushCache")
+
+	if err := ctx.Cache.Flush(); err != nil {
+		ctx.Logger.Warn("FlushCache err: %s", err)
+		return err
+	}
+
 	return nil
 }
 
+// ListImages list origin images in kimg storage page by page according to a list request.
+func (ctx *KimgContext) ListImages(req *KimgListRequest) (*KimgListResponse, error) {
+
+	ctx.Logger.Debug("ListImages req: %#v", req)
+
+	resp := &KimgListResponse{Images: make([]*KimgListItem, 0, req.Limit)}
+	cursor := req.Cursor
+
+	for {
+		items, next, err := ctx.Storage.List(cursor, req.Limit)
+		if err != nil {
+			ctx.Logger.Warn("ListImages cursor: %s, ListStorage err: %s", cursor, err)
+			return nil, err
+		}
+
+		for i, item := range items {
+			cursor = item.Md5
+			if !req.From.IsZero() && item.Created.Before(req.From) {
+				continue
+			}
+			if !req.To.IsZero() && !item.Created.Before(req.To) {
+				continue
+			}
+
+			if len(req.Tags) > 0 {
+				meta, err := ctx.Storage.GetMeta(ctx.originRequest(item.Md5))
+				if err != nil || !meta.HasTags(req.Tags) {
+					continue
+				}
+			}
+
+			listItem := &KimgListItem{
+				Md5:     item.Md5,
+				URL:     ctx.imageURL(item.Md5),
+				Size:    int(item.Size),
+				Created: item.Created,
+			}
+			if req.Info || len(req.Format) > 0 {
+				info, err := ctx.InfoImage(ctx.originRequest(item.Md5))
+				if err != nil {
+					ctx.Logger.Warn("ListImages md5Sum: %s, InfoImage err: %s", item.Md5, err)
+					continue
+				}
+				if len(req.Format) > 0 && !isSameFormat(req.Format, info.Format) {
+					continue
+				}
+				listItem.Format = info.Format
+				listItem.Width = info.Width
+				listItem.Height = info.Height
+			}
+
+			resp.Images = append(resp.Images, listItem)
+			if len(resp.Images) >= req.Limit {
+				if i < len(items)-1 || len(next) > 0 {
+					resp.Cursor = cursor
+				}
+				return resp, nil
+			}
+		}
+
+		if len(next) == 0 {
+			return resp, nil
+		}
+		cursor = next
+	}
+}
+
+// SimilarImages find near-duplicate images of a image within the hamming distance of perceptual hash.
+func (ctx *KimgContext) SimilarImages(md5Sum string, distance int) (*KimgSimilarResponse, error) {
+
+	ctx.Logger.Debug("SimilarImages md5Sum: %s, distance: %d", md5Sum, distance)
+
+	if ctx.PHash == nil {
+		return nil, errors.New("similar search disabled")
+	}
+
+	hash, err := ctx.PHash.Get(md5Sum)
+	if err != nil {
+		ctx.Logger.Warn("SimilarImages md5Sum: %s, PHash.Get err: %s", md5Sum, err)
+		return nil, err
+	}
+
+	resp := &KimgSimilarResponse{
+		Md5:     md5Sum,
+		PHash:   formatPHash(hash),
+		Similar: make([]*KimgSimilar, 0),
+	}
+	for _, similar := range ctx.PHash.Search(hash, distance) {
+		if similar.Md5 != md5Sum {
+			resp.Similar = append(resp.Similar, similar)
+		}
+	}
+
+	return resp, nil
+}
+
+// DetectMark extract the invisible watermark payload from a image.
+func (ctx *KimgContext) DetectMark(data []byte) (*KimgMarkResponse, error) {
+
+	ctx.Logger.Debug("DetectMark size: %d", len(data))
+
+	payload, confidence, err := ctx.Image.DetectMark(data)
+	if errors.Is(err, ErrNoWatermark) {
+		return &KimgMarkResponse{Confidence: confidence}, nil
+	} else if err != nil {
+		ctx.Logger.Warn("DetectMark err: %s", err)
+		return nil, err
+	}
+
+	return &KimgMarkResponse{
+		Found:      true,
+		Payload:    payload,
+		Confidence: confidence,
+	}, nil
+}
+
+// SrcsetImage generate the srcset of image variants in widths and formats,
+// and render all variants in background if prerender requested.
+func (ctx *KimgContext) SrcsetImage(req *KimgSrcsetRequest) (*KimgSrcsetResponse, error) {
+
+	ctx.Logger.Debug("SrcsetImage md5Sum: %s, widths: %v, formats: %v", req.Md5, req.Widths, req.Formats)
+
+	info, err := ctx.InfoImage(ctx.originRequest(req.Md5))
+	if err != nil {
+		ctx.Logger.Warn("SrcsetImage md5Sum: %s, InfoImage err: %s", req.Md5, err)
+		return nil, err
+	}
+
+	widths := make([]int, 0, len(req.Widths))
+	for _, w := range req.Widths {
+		if w >= info.Width {
+			widths = append(widths, info.Width)
+			break
+		}
+		widths = append(widths, w)
+	}
+
+	resp := &KimgSrcsetResponse{
+		Md5:      req.Md5,
+		Width:    info.Width,
+		Height:   info.Height,
+		Srcset:   make(map[string]string),
+		Variants: make([]*KimgSrcsetVariant, 0),
+	}
+	reqs := make([]*KimgRequest, 0)
+	for _, format := range req.Formats {
+		items := make([]string, 0, len(widths))
+		for _, w := range widths {
+			values := make(url.Values)
+			for k, v := range req.Query {
+				values[k] = v
+			}
+			values.Del("sh")
+			values.Set("s", "1")
+			values.Set("sw", strconv.Itoa(w))
+			values.Set("f", format)
+			if req.Sign {
+				values.Set("sig", ctx.sign(req.Md5, values))
+			}
+
+			u := ctx.imageURL(req.Md5) + "?" + values.Encode()
+			items = append(items, fmt.Sprintf("%s %dw", u, w))
+			resp.Variants = append(resp.Variants, &KimgSrcsetVariant{
+				Format: format,
+				Width:  w,
+				URL:    u,
+			})
+			if req.Prerender {
+				r := ctx.genRequest(&http.Request{Form: values}, req.Md5)
+				r.Save = true
+				reqs = append(reqs, r)
+			}
+		}
+		resp.Srcset[format] = strings.Join(items, ", ")
+	}
+
+	// variants are rendered by eager queue, so that they are stored and cached before the first visit.
+	for _, r := range reqs {
+		if !ctx.Eager.Push(r) {
+			ctx.Logger.Warn("SrcsetImage md5Sum: %s, key: %s, queue full", r.Md5, r.Key())
+		}
+	}
+
+	return resp, nil
+}
+
+// applyFocal set the focal point stored in image metadata to a crop or fill request without one.
+// style requests are left as is, as they fetch derivatives saved by name without crop params.
+func (ctx *KimgContext) applyFocal(req *KimgRequest) {
+	if req.Origin || len(req.Style) > 0 || req.Focal {
+		return
+	}
+	if !req.Crop && !(req.Scale && req.ScaleM == "fill") {
+		return
+	}
+
+	fx, fy, ok := ctx.focalPoint(req.Md5)
+	if !ok {
+		return
+	}
+	req.Focal = true
+	req.FocalX = fx
+	req.FocalY = fy
+	ctx.Logger.Debug("GetImage md5Sum: %s, focal %f %f", req.Md5, req.FocalX, req.FocalY)
+}
+
+// focalPoint get the focal point of a image from cache, or from metadata in storage on cache miss,
+// the result is cached even if there is no focal point, so storage is not read on each request.
+func (ctx *KimgContext) focalPoint(md5Sum string) (float64, float64, bool) {
+	key := focalCacheKey(md5Sum)
+	if ctx.isCacheEnable(nil) {
+		if data, err := ctx.Cache.Get(key); err == nil {
+			var fx, fy float64
+			if n, _ := fmt.Sscanf(string(data), "%g,%g", &fx, &fy); n == 2 {
+				return fx, fy, true
+			}
+			return 0, 0, false
+		}
+	}
+
+	if ctx.Negative != nil && ctx.Negative.Missing(md5Sum) {
+		return 0, 0, false
+	}
+	meta, err := ctx.Storage.GetMeta(ctx.originRequest(md5Sum))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var data []byte
+	ok := meta.FX != nil && meta.FY != nil && meta.ValidFocal()
+	if ok {
+		data = []byte(fmt.Sprintf("%g,%g", *meta.FX, *meta.FY))
+	}
+	if ctx.isCacheEnable(nil) {
+		if err := ctx.Cache.SetTTL(key, data, time.Duration(ctx.Config.Cache.TTL.Derivative)*time.Second); err != nil {
+			ctx.Logger.Warn("GetImage md5Sum: %s, SetCache %s err: %s", md5Sum, key, err)
+		}
+	}
+	if !ok {
+		return 0, 0, false
+	}
+	return *meta.FX, *meta.FY, true
+}
+
+// focalCacheKey return the cache key of focal point of a image, "@" keeps it apart from style names.
+func focalCacheKey(md5Sum string) string {
+	return md5Sum + ":@focal"
+}
+
 func (ctx *KimgContext) isCacheEnable(data []byte) bool {
 	return ctx.Cache != nil && (data != nil || ctx.Config.Cache.MaxSize >= len(data))
 }
 
+// cacheTTL return the cache expiry of a image request by origin or derivative.
+func (ctx *KimgContext) cacheTTL(req *KimgRequest) time.Duration {
+	if req.Origin {
+		return time.Duration(ctx.Config.Cache.TTL.Origin) * time.Second
+	}
+	return time.Duration(ctx.Config.Cache.TTL.Derivative) * time.Second
+}
+
 func (ctx *KimgContext) cacheKey(req *KimgRequest) string {
 	if req.Origin {
 		return req.Md5
@@ -308,6 +1055,24 @@ func (ctx *KimgContext) cacheKey(req *KimgRequest) string {
 	return fmt.Sprintf("%s:%s", req.Md5, req.Key())
 }
 
+func (ctx *KimgContext) imageURL(md5Sum string) string {
+	u, _ := url.Parse(ctx.Config.Httpd.URL)
+	u.Path = fmt.Sprintf("image/%s", md5Sum)
+	return u.String()
+}
+
 func (ctx *KimgContext) originRequest(md5Sum string) *KimgRequest {
 	return &KimgRequest{Md5: md5Sum, Origin: true}
 }
+
+func isSameFormat(a, b string) bool {
+	a = strings.ToLower(a)
+	b = strings.ToLower(b)
+	if a == "jpg" {
+		a = "jpeg"
+	}
+	if b == "jpg" {
+		b = "jpeg"
+	}
+	return a == b
+}
@@ -0,0 +1,101 @@
+package kimg
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// KimgEagerQueue background queue rendering image derivatives after upload.
+type KimgEagerQueue struct {
+	ctx    *KimgContext
+	reqs   chan *KimgRequest
+	wg     sync.WaitGroup
+	mtx    sync.RWMutex
+	closed bool
+}
+
+// NewKimgEagerQueue create a eager render queue instance with size pending requests and workers.
+func NewKimgEagerQueue(ctx *KimgContext, size, workers int) *KimgEagerQueue {
+	queue := &KimgEagerQueue{
+		ctx:  ctx,
+		reqs: make(chan *KimgRequest, maxInt(1, size)),
+	}
+	for i := 0; i < maxInt(1, workers); i++ {
+		queue.wg.Add(1)
+		go queue.work()
+	}
+	return queue
+}
+
+// Push add a image request to queue, it returns false if queue is full or closed.
+func (queue *KimgEagerQueue) Push(req *KimgRequest) bool {
+	queue.mtx.RLock()
+	defer queue.mtx.RUnlock()
+
+	if queue.closed {
+		return false
+	}
+	select {
+	case queue.reqs <- req:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stop accepting requests and wait pending requests rendered.
+func (queue *KimgEagerQueue) Close() {
+	queue.mtx.Lock()
+	if !queue.closed {
+		queue.closed = true
+		close(queue.reqs)
+	}
+	queue.mtx.Unlock()
+
+	queue.wg.Wait()
+}
+
+func (queue *KimgEagerQueue) work() {
+	defer queue.wg.Done()
+
+	for req := range queue.reqs {
+		if _, err := queue.ctx.GetImage(req); err != nil {
+			queue.ctx.Logger.Warn("EagerQueue md5Sum: %s, key: %s, GetImage err: %s", req.Md5, req.Key(), err)
+			continue
+		}
+		queue.ctx.Logger.Debug("EagerQueue md5Sum: %s, key: %s", req.Md5, req.Key())
+	}
+}
+
+// renderPresets render the configured presets of a image synchronously or via eager queue,
+// the rendered derivatives are saved to storage and cache, and their urls returned by preset name.
+func (ctx *KimgContext) renderPresets(md5Sum string, sync bool) map[string]string {
+	urls := make(map[string]string)
+	for name, preset := range ctx.Config.Eager.Presets {
+		values, err := url.ParseQuery(preset)
+		if err != nil {
+			ctx.Logger.Warn("renderPresets md5Sum: %s, preset: %s, ParseQuery err: %s", md5Sum, name, err)
+			continue
+		}
+
+		// signed before generating request, so that options trusted with signature only apply.
+		if len(ctx.Config.Httpd.SignKey) > 0 {
+			values.Set("sig", ctx.sign(md5Sum, values))
+		}
+
+		req := ctx.genRequest(&http.Request{Form: values}, md5Sum)
+		req.Save = true
+		if sync {
+			if _, err := ctx.GetImage(req); err != nil {
+				ctx.Logger.Warn("renderPresets md5Sum: %s, preset: %s, GetImage err: %s", md5Sum, name, err)
+				continue
+			}
+		} else if !ctx.Eager.Push(req) {
+			ctx.Logger.Warn("renderPresets md5Sum: %s, preset: %s, queue full", md5Sum, name)
+		}
+
+		urls[name] = ctx.imageURL(md5Sum) + "?" + values.Encode()
+	}
+	return urls
+}
@@ -2,16 +2,23 @@ package kimg
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
 	"embed"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"io"
 	"io/fs"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -28,6 +35,9 @@ var contentTypes = map[string]string{
 //go:embed web/dist
 var www embed.FS
 
+// maxSigma is the max sigma of blur and sharpen requested.
+const maxSigma = 20
+
 func (ctx *KimgContext) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	mux := http.NewServeMux()
@@ -41,6 +51,15 @@ func (ctx *KimgContext) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}))
 
+	mux.HandleFunc("/watermark/detect", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			{
+				ctx.detectMark(w, r)
+			}
+		}
+	}))
+
 	mux.HandleFunc("/image/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		md5Sum := r.URL.Path[7:len(r.URL.Path)]
 		if !ctx.isValidMd5(md5Sum) {
@@ -73,6 +92,80 @@ func (ctx *KimgContext) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}))
 
+	mux.HandleFunc("/similar/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		md5Sum := r.URL.Path[9:len(r.URL.Path)]
+		if !ctx.isValidMd5(md5Sum) {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			{
+				ctx.similar(w, r, md5Sum)
+			}
+		}
+	}))
+
+	mux.HandleFunc("/srcset/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		md5Sum := r.URL.Path[8:len(r.URL.Path)]
+		if !ctx.isValidMd5(md5Sum) {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			{
+				ctx.srcset(w, r, md5Sum)
+			}
+		}
+	}))
+
+	mux.HandleFunc("/meta/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		md5Sum := r.URL.Path[6:len(r.URL.Path)]
+		if !ctx.isValidMd5(md5Sum) {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			{
+				ctx.getMeta(w, r, md5Sum)
+			}
+		case "PUT", "PATCH":
+			{
+				ctx.setMeta(w, r, md5Sum)
+			}
+		}
+	}))
+
+	mux.HandleFunc("/images", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			{
+				ctx.list(w, r)
+			}
+		}
+	}))
+
+	if len(ctx.Config.Httpd.AdminKey) > 0 {
+		mux.HandleFunc("/admin/cache", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !ctx.isAdmin(r) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			switch r.Method {
+			case "GET":
+				{
+					ctx.cacheStats(w, r)
+				}
+			case "DELETE":
+				{
+					ctx.purgeCache(w, r)
+				}
+			}
+		}))
+	}
+
 	if ctx.Config.Httpd.EnableWeb {
 		fsys, _ := fs.Sub(www, "web/dist")
 		mux.Handle("/", http.FileServer(http.FS(fsys)))
@@ -81,10 +174,12 @@ func (ctx *KimgContext) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	mux.ServeHTTP(w, r)
 }
 
-func (ctx *KimgContext) post(w http.ResponseWriter, r *http.Request) {
+// readImage read the uploaded image from raw body or multipart form,
+// it writes the error response and returns nil if failed.
+func (ctx *KimgContext) readImage(w http.ResponseWriter, r *http.Request) []byte {
 	if r.ContentLength > ctx.Config.Httpd.MaxSize {
 		http.Error(w, "Payload Too Large", http.StatusRequestEntityTooLarge)
-		return
+		return nil
 	}
 
 	var rd io.Reader
@@ -94,33 +189,68 @@ func (ctx *KimgContext) post(w http.ResponseWriter, r *http.Request) {
 	} else if strings.HasPrefix(contentType, "multipart/form-data") {
 		if err := r.ParseMultipartForm(ctx.Config.Httpd.MaxSize); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil
 		}
 		file, _, err := r.FormFile(ctx.Config.Httpd.FormName)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil
 		}
 		rd = file
 	} else {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
-		return
+		return nil
 	}
 
 	data, err := ioutil.ReadAll(rd)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil
 	}
 
 	fileType := http.DetectContentType(data)
 	if !ctx.isAllowedType(fileType) {
 		http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return nil
+	}
+	return data
+}
+
+func (ctx *KimgContext) post(w http.ResponseWriter, r *http.Request) {
+	data := ctx.readImage(w, r)
+	if data == nil {
 		return
 	}
 
-	resp, err := ctx.SaveImage(data)
-	if err != nil {
+	opts := &KimgSaveOptions{Duplicate: ctx.Config.Similar.Duplicate}
+	if v := r.URL.Query().Get("dup"); len(v) > 0 {
+		opts.Duplicate = v
+	}
+	if ctx.Config.Eager.Enable {
+		opts.Eager = "async"
+		if ctx.Config.Eager.Sync {
+			opts.Eager = "sync"
+		}
+	}
+	if v, ok := r.URL.Query()["eager"]; ok {
+		switch v[0] {
+		case "sync", "async":
+			opts.Eager = v[0]
+		case "0":
+			opts.Eager = ""
+		default:
+			opts.Eager = "async"
+		}
+	}
+
+	resp, err := ctx.SaveImage(data, opts)
+	if errors.Is(err, ErrDuplicateImage) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(resp)
+		ctx.Logger.Info("POST rejected, duplicate of md5: %s", resp.DuplicateOf)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -131,6 +261,24 @@ func (ctx *KimgContext) post(w http.ResponseWriter, r *http.Request) {
 	ctx.Logger.Info("POST md5: %s, size: %d", resp.Md5, resp.Size)
 }
 
+func (ctx *KimgContext) detectMark(w http.ResponseWriter, r *http.Request) {
+	data := ctx.readImage(w, r)
+	if data == nil {
+		return
+	}
+
+	resp, err := ctx.DetectMark(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+
+	ctx.Logger.Info("DETECT size: %d, found: %t", len(data), resp.Found)
+}
+
 func (ctx *KimgContext) info(w http.ResponseWriter, r *http.Request, md5Sum string) {
 	if err := r.ParseForm(); err != nil {
 		ctx.Logger.Warn(err.Error())
@@ -139,6 +287,21 @@ func (ctx *KimgContext) info(w http.ResponseWriter, r *http.Request, md5Sum stri
 	}
 
 	req := ctx.genRequest(r, md5Sum)
+	if v, ok := r.Form["ph"]; ok {
+		req.Placeholder = v[0] != "0"
+	}
+	if v, ok := r.Form["trim"]; ok {
+		req.TrimBox = v[0] != "0"
+		if v, ok := r.Form["tf"]; ok {
+			req.TrimFuzz = clampInt(atoi(v[0]), 0, 100)
+		}
+	}
+	if v, ok := r.Form["palette"]; ok {
+		req.Palette, _ = strconv.Atoi(v[0])
+		if req.Palette > 256 {
+			req.Palette = 256
+		}
+	}
 
 	resp, err := ctx.InfoImage(req)
 	if err != nil {
@@ -152,6 +315,148 @@ func (ctx *KimgContext) info(w http.ResponseWriter, r *http.Request, md5Sum stri
 	ctx.Logger.Info("INFO md5: %s", md5Sum)
 }
 
+func (ctx *KimgContext) similar(w http.ResponseWriter, r *http.Request, md5Sum string) {
+	if err := r.ParseForm(); err != nil {
+		ctx.Logger.Warn(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	distance := ctx.Config.Similar.Distance
+	if v, ok := r.Form["distance"]; ok {
+		distance, _ = strconv.Atoi(v[0])
+	}
+
+	resp, err := ctx.SimilarImages(md5Sum, distance)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+
+	ctx.Logger.Info("SIMILAR md5: %s, distance: %d, count: %d", md5Sum, distance, len(resp.Similar))
+}
+
+func (ctx *KimgContext) srcset(w http.ResponseWriter, r *http.Request, md5Sum string) {
+	if err := r.ParseForm(); err != nil {
+		ctx.Logger.Warn(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	req, err := ctx.genSrcsetRequest(r, md5Sum)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := ctx.SrcsetImage(req)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if v, ok := r.Form["html"]; ok && v[0] != "0" {
+		alt := ""
+		if meta, err := ctx.GetImageMeta(md5Sum); err == nil {
+			alt = meta.Alt
+		}
+		sizes := ""
+		if v, ok := r.Form["sizes"]; ok && len(v[0]) > 0 {
+			sizes = fmt.Sprintf(` sizes="%s"`, html.EscapeString(v[0]))
+		}
+
+		var sb strings.Builder
+		sb.WriteString("<picture>")
+		fallback := req.Formats[len(req.Formats)-1]
+		for _, format := range req.Formats[:len(req.Formats)-1] {
+			sb.WriteString(fmt.Sprintf(`<source type="%s" srcset="%s"%s>`, contentTypes[format], html.EscapeString(resp.Srcset[format]), sizes))
+		}
+		src := resp.Variants[len(resp.Variants)-1].URL
+		sb.WriteString(fmt.Sprintf(`<img src="%s" srcset="%s"%s width="%d" height="%d" alt="%s">`,
+			html.EscapeString(src), html.EscapeString(resp.Srcset[fallback]), sizes, resp.Width, resp.Height, html.EscapeString(alt)))
+		sb.WriteString("</picture>")
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, sb.String())
+	} else {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(resp)
+	}
+
+	ctx.Logger.Info("SRCSET md5: %s, variants: %d", md5Sum, len(resp.Variants))
+}
+
+func (ctx *KimgContext) getMeta(w http.ResponseWriter, r *http.Request, md5Sum string) {
+	meta, err := ctx.GetImageMeta(md5Sum)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(meta)
+
+	ctx.Logger.Info("GET META md5: %s", md5Sum)
+}
+
+func (ctx *KimgContext) setMeta(w http.ResponseWriter, r *http.Request, md5Sum string) {
+	meta := &KimgMeta{}
+	if r.Method == "PATCH" {
+		var err error
+		if meta, err = ctx.GetImageMeta(md5Sum); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(meta); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !meta.ValidFocal() {
+		http.Error(w, "invalid focal point", http.StatusBadRequest)
+		return
+	}
+
+	if err := ctx.SetImageMeta(md5Sum, meta); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(meta)
+
+	ctx.Logger.Info("%s META md5: %s", r.Method, md5Sum)
+}
+
+func (ctx *KimgContext) list(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		ctx.Logger.Warn(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	req, err := ctx.genListRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := ctx.ListImages(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+
+	ctx.Logger.Info("LIST cursor: %s, count: %d", req.Cursor, len(resp.Images))
+}
+
 func (ctx *KimgContext) get(w http.ResponseWriter, r *http.Request, md5Sum string) {
 	if err := r.ParseForm(); err != nil {
 		ctx.Logger.Warn(err.Error())
@@ -159,6 +464,15 @@ func (ctx *KimgContext) get(w http.ResponseWriter, r *http.Request, md5Sum strin
 		return
 	}
 
+	if len(ctx.Config.Httpd.SignKey) > 0 {
+		query := r.URL.Query()
+		sig := query.Get("sig")
+		if (len(sig) > 0 || ctx.Config.Httpd.SignOnly) && !hmac.Equal([]byte(sig), []byte(ctx.sign(md5Sum, query))) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
 	req := ctx.genRequest(r, md5Sum)
 
 	data, err := ctx.GetImage(req)
@@ -177,6 +491,9 @@ func (ctx *KimgContext) get(w http.ResponseWriter, r *http.Request, md5Sum strin
 	}
 
 	w.Header().Set("X-Kimg-Style", req.Key())
+	if req.LQIP {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
 
 	if ctx.Config.Httpd.Etag {
 		m := md5.New()
@@ -209,6 +526,70 @@ func (ctx *KimgContext) delete(w http.ResponseWriter, r *http.Request, md5Sum st
 	ctx.Logger.Info("DELETE md5: %s", md5Sum)
 }
 
+func (ctx *KimgContext) cacheStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := ctx.CacheStats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(stats)
+
+	ctx.Logger.Info("CACHE STATS mode: %s", stats.Mode)
+}
+
+// purgeCache delete a key with ?key=, derivatives of a image with ?md5= or all with ?all=1 from cache.
+func (ctx *KimgContext) purgeCache(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		ctx.Logger.Warn(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var resp *KimgCachePurgeResponse
+	var err error
+	if key := r.Form.Get("key"); len(key) > 0 {
+		resp, err = ctx.PurgeCache(key)
+	} else if md5Sum := r.Form.Get("md5"); len(md5Sum) > 0 {
+		if !ctx.isValidMd5(md5Sum) {
+			http.Error(w, "invalid md5", http.StatusBadRequest)
+			return
+		}
+		resp, err = ctx.PurgeImageCache(md5Sum)
+	} else if r.Form.Get("all") == "1" {
+		if err = ctx.FlushCache(); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			ctx.Logger.Info("CACHE FLUSH")
+			return
+		}
+	} else {
+		http.Error(w, "key, md5 or all required", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+
+	ctx.Logger.Info("CACHE PURGE %s, purged: %d", r.Form.Encode(), resp.Purged)
+}
+
+// isAdmin check the admin key of request, it is false if admin key not configured.
+func (ctx *KimgContext) isAdmin(r *http.Request) bool {
+	key := ctx.Config.Httpd.AdminKey
+	return len(key) > 0 && hmac.Equal([]byte(r.Header.Get("X-Kimg-Admin-Key")), []byte(key))
+}
+
+// isSigned check the signature of request, it is false if sign key not configured or signature missing.
+func (ctx *KimgContext) isSigned(r *http.Request, md5Sum string) bool {
+	sig := r.Form.Get("sig")
+	return len(ctx.Config.Httpd.SignKey) > 0 && len(sig) > 0 && hmac.Equal([]byte(sig), []byte(ctx.sign(md5Sum, r.Form)))
+}
+
 func (ctx *KimgContext) isAllowedType(fileType string) bool {
 	types := ctx.Config.Image.AllowedTypes
 	for _, t := range types {
@@ -226,6 +607,155 @@ func (ctx *KimgContext) isValidMd5(md5 string) bool {
 	return regexp.MustCompile(`^([0-9a-zA-Z]){32}$`).MatchString(md5)
 }
 
+func (ctx *KimgContext) genListRequest(r *http.Request) (*KimgListRequest, error) {
+	var req KimgListRequest
+
+	req.Limit = 20
+	if v, ok := r.Form["limit"]; ok {
+		req.Limit, _ = strconv.Atoi(v[0])
+		if req.Limit <= 0 {
+			req.Limit = 20
+		} else if req.Limit > 1000 {
+			req.Limit = 1000
+		}
+	}
+
+	if v, ok := r.Form["cursor"]; ok && len(v[0]) > 0 {
+		if !ctx.isValidMd5(v[0]) {
+			return nil, fmt.Errorf("invalid cursor %s", v[0])
+		}
+		req.Cursor = v[0]
+	}
+
+	if v, ok := r.Form["f"]; ok {
+		req.Format = strings.ToLower(v[0])
+	}
+
+	if v, ok := r.Form["tag"]; ok {
+		req.Tags = v
+	}
+
+	if v, ok := r.Form["info"]; ok {
+		req.Info = v[0] != "0"
+	}
+
+	if v, ok := r.Form["from"]; ok {
+		t, err := parseTime(v[0])
+		if err != nil {
+			return nil, err
+		}
+		req.From = t
+	}
+	if v, ok := r.Form["to"]; ok {
+		t, err := parseTime(v[0])
+		if err != nil {
+			return nil, err
+		}
+		req.To = t
+	}
+
+	return &req, nil
+}
+
+func (ctx *KimgContext) genSrcsetRequest(r *http.Request, md5Sum string) (*KimgSrcsetRequest, error) {
+	req := KimgSrcsetRequest{
+		Md5:   md5Sum,
+		Query: make(url.Values),
+	}
+
+	if v, ok := r.Form["widths"]; ok && len(v[0]) > 0 {
+		for _, s := range strings.Split(v[0], ",") {
+			w, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || w <= 0 || w > 10000 {
+				return nil, fmt.Errorf("invalid width %s", s)
+			}
+			req.Widths = append(req.Widths, w)
+		}
+	} else {
+		req.Widths = append(req.Widths, ctx.Config.Image.Srcset.Widths...)
+	}
+	if len(req.Widths) == 0 || len(req.Widths) > 20 {
+		return nil, errors.New("invalid widths")
+	}
+	sort.Ints(req.Widths)
+
+	format := ctx.Config.Image.Format
+	if v, ok := r.Form["f"]; ok && len(v[0]) > 0 {
+		format = strings.ToLower(v[0])
+	}
+	if "auto" == format {
+		req.Formats = append(req.Formats, "webp")
+		if format = ctx.Config.Image.Format; "none" == format || "webp" == format {
+			format = ""
+		}
+	}
+	if len(format) > 0 {
+		if !ctx.isAllowedType(format) {
+			return nil, fmt.Errorf("unsupported format %s", format)
+		}
+		req.Formats = append(req.Formats, format)
+	}
+
+	if v, ok := r.Form["sign"]; ok && v[0] != "0" {
+		if len(ctx.Config.Httpd.SignKey) == 0 {
+			return nil, errors.New("sign key not configured")
+		}
+		// signing any params for anyone defeats signed urls, so it is for admin only.
+		if !ctx.isAdmin(r) {
+			return nil, errors.New("sign requires admin key")
+		}
+		req.Sign = true
+	}
+	if v, ok := r.Form["prerender"]; ok {
+		req.Prerender = v[0] != "0"
+	}
+
+	for k, v := range r.URL.Query() {
+		switch k {
+		case "widths", "f", "sign", "prerender", "html", "sizes", "sig":
+		default:
+			req.Query[k] = v
+		}
+	}
+
+	return &req, nil
+}
+
+// sign return the signature of a image url, hmac-sha256 of the path and sorted query except sig.
+func (ctx *KimgContext) sign(md5Sum string, values url.Values) string {
+	query := make(url.Values)
+	for k, v := range values {
+		if k != "sig" {
+			query[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(ctx.Config.Httpd.SignKey))
+	mac.Write([]byte("/image/" + md5Sum + "?" + query.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+func atoi(s string) int {
+	i, _ := strconv.Atoi(s)
+	return i
+}
+
+func clampInt(i, min, max int) int {
+	if i < min {
+		return min
+	}
+	if i > max {
+		return max
+	}
+	return i
+}
+
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
 func (ctx *KimgContext) genRequest(r *http.Request, md5Sum string) *KimgRequest {
 	var req KimgRequest
 
@@ -236,6 +766,10 @@ func (ctx *KimgContext) genRequest(r *http.Request, md5Sum string) *KimgRequest
 		return &req
 	}
 
+	if ctx.Config.Watermark.Enable {
+		req.Watermark = "default"
+	}
+
 	if v, ok := r.Form["style"]; ok {
 		req.Style = v[0]
 		return &req
@@ -247,6 +781,29 @@ func (ctx *KimgContext) genRequest(r *http.Request, md5Sum string) *KimgRequest
 		req.Save = ctx.Config.Storage.SaveNew
 	}
 
+	if v, ok := r.Form["lqip"]; ok && v[0] != "0" {
+		req.LQIP = true
+		req.Scale = true
+		req.ScaleW = ctx.Config.Image.LQIP.Width
+		req.Format = ctx.Config.Image.Format
+		req.Quality = ctx.Config.Image.LQIP.Quality
+		req.AutoOrient = true
+		req.Strip = true
+		return &req
+	}
+
+	if v, ok := r.Form["trim"]; ok {
+		req.Trim = v[0] != "0"
+	}
+	if req.Trim {
+		if v, ok := r.Form["tf"]; ok {
+			req.TrimFuzz = clampInt(atoi(v[0]), 0, 100)
+		}
+		if v, ok := r.Form["tp"]; ok {
+			req.TrimPad = clampInt(atoi(v[0]), 0, 10000)
+		}
+	}
+
 	if v, ok := r.Form["s"]; ok {
 		req.Scale = v[0] != "0"
 	}
@@ -298,6 +855,115 @@ func (ctx *KimgContext) genRequest(r *http.Request, md5Sum string) *KimgRequest
 		}
 	}
 
+	if req.Crop || req.ScaleM == "fill" {
+		fx, okX := r.Form["fx"]
+		fy, okY := r.Form["fy"]
+		if okX && okY {
+			x, errX := strconv.ParseFloat(fx[0], 64)
+			y, errY := strconv.ParseFloat(fy[0], 64)
+			if errX == nil && errY == nil && !math.IsNaN(x) && !math.IsNaN(y) {
+				req.Focal = true
+				req.FocalX = math.Max(0, math.Min(1, x))
+				req.FocalY = math.Max(0, math.Min(1, y))
+			}
+		}
+	}
+
+	if v, ok := r.Form["norm"]; ok {
+		req.Normalize = v[0] != "0"
+	}
+	if v, ok := r.Form["al"]; ok {
+		req.AutoLevel = v[0] != "0"
+	}
+	if v, ok := r.Form["bri"]; ok {
+		req.Brightness = clampInt(atoi(v[0]), -100, 100)
+	}
+	if v, ok := r.Form["con"]; ok {
+		req.Contrast = clampInt(atoi(v[0]), -100, 100)
+	}
+	if v, ok := r.Form["sat"]; ok {
+		req.Saturation = clampInt(atoi(v[0]), -100, 100)
+	}
+	if v, ok := r.Form["hue"]; ok {
+		req.Hue = clampInt(atoi(v[0]), -100, 100)
+	}
+	if v, ok := r.Form["gm"]; ok {
+		if gamma, err := strconv.ParseFloat(v[0], 64); err == nil && !math.IsNaN(gamma) {
+			req.Gamma = math.Max(0, math.Min(10, gamma))
+		}
+	}
+	// sigma is capped low, as the cost of blur and sharpen grows with it.
+	if v, ok := r.Form["blur"]; ok {
+		if sigma, err := strconv.ParseFloat(v[0], 64); err == nil && !math.IsNaN(sigma) {
+			req.Blur = math.Max(0, math.Min(maxSigma, sigma))
+		}
+	}
+	if v, ok := r.Form["sharpen"]; ok {
+		if sigma, err := strconv.ParseFloat(v[0], 64); err == nil && !math.IsNaN(sigma) {
+			req.Sharpen = math.Max(0, math.Min(maxSigma, sigma))
+		}
+	}
+	if v, ok := r.Form["sepia"]; ok {
+		req.Sepia = clampInt(atoi(v[0]), 0, 100)
+	}
+	if v, ok := r.Form["neg"]; ok {
+		req.Negate = v[0] != "0"
+	}
+
+	if v, ok := r.Form["pad"]; ok {
+		req.Pad = v[0] != "0"
+	}
+	if req.Pad {
+		req.PadW, req.PadH = req.ScaleW, req.ScaleH
+		if v, ok := r.Form["pdw"]; ok {
+			req.PadW, _ = strconv.Atoi(v[0])
+		}
+		if v, ok := r.Form["pdh"]; ok {
+			req.PadH, _ = strconv.Atoi(v[0])
+		}
+	}
+	if v, ok := r.Form["bw"]; ok {
+		req.BorderW = clampInt(atoi(v[0]), 0, 1000)
+		req.BorderColor = "#000000"
+		if v, ok := r.Form["bcl"]; ok && len(v[0]) == 6 {
+			req.BorderColor = "#" + v[0]
+		}
+	}
+	if v, ok := r.Form["rr"]; ok {
+		req.Radius = clampInt(atoi(v[0]), 0, 10000)
+	}
+	if v, ok := r.Form["circle"]; ok {
+		req.Circle = v[0] != "0"
+	}
+
+	if v, ok := r.Form["wm"]; ok {
+		if v[0] == "none" {
+			// opt out of watermark is trusted with a valid signature or admin key only.
+			if ctx.isSigned(r, md5Sum) || ctx.isAdmin(r) {
+				req.Watermark = ""
+			}
+		} else if _, exist := ctx.Config.Watermark.Profiles[v[0]]; exist || v[0] == "default" {
+			req.Watermark = v[0]
+		}
+	}
+	if v, ok := r.Form["wmt"]; ok && len(v[0]) > 0 {
+		req.WatermarkText = v[0]
+	}
+	if v, ok := r.Form["wms"]; ok {
+		req.WatermarkSize = clampInt(atoi(v[0]), 0, 1000)
+	}
+	if v, ok := r.Form["wmc"]; ok && len(v[0]) == 6 {
+		req.WatermarkColor = "#" + v[0]
+	}
+	if v, ok := r.Form["wmg"]; ok {
+		if _, exist := gravityMaps[v[0]]; exist {
+			req.WatermarkGravity = v[0]
+		}
+	}
+	if v, ok := r.Form["mark"]; ok && ctx.Config.Mark.Enable && len(v[0]) > 0 && len(v[0]) <= markPayload {
+		req.Mark = v[0]
+	}
+
 	if v, ok := r.Form["f"]; ok {
 		req.Format = strings.ToLower(v[0])
 		if !ctx.isAllowedType(req.Format) {
@@ -318,8 +984,21 @@ func (ctx *KimgContext) genRequest(r *http.Request, md5Sum string) *KimgRequest
 		req.Quality = ctx.Config.Image.Quality
 	}
 
+	if v, ok := r.Form["flip"]; ok {
+		req.Flip = v[0] != "0"
+	}
+	if v, ok := r.Form["flop"]; ok {
+		req.Flop = v[0] != "0"
+	}
 	if v, ok := r.Form["r"]; ok {
-		req.Rotate, _ = strconv.Atoi(v[0])
+		req.Rotate, _ = strconv.ParseFloat(v[0], 64)
+		req.Rotate = math.Mod(req.Rotate, 360)
+		if math.IsNaN(req.Rotate) {
+			req.Rotate = 0
+		}
+	}
+	if v, ok := r.Form["rm"]; ok && req.Rotate != 0 {
+		req.RotateM = v[0]
 	}
 	if v, ok := r.Form["bc"]; ok && len(v[0]) == 6 {
 		req.BGColor = "#" + v[0]
@@ -334,8 +1013,30 @@ func (ctx *KimgContext) genRequest(r *http.Request, md5Sum string) *KimgRequest
 	}
 	if v, ok := r.Form["st"]; ok {
 		req.Strip = v[0] != "0"
+		if _, exist := stripPolicies[v[0]]; exist {
+			req.StripPolicy = v[0]
+		}
 	} else {
 		req.Strip = true
 	}
+	if req.Strip && len(req.StripPolicy) == 0 {
+		req.StripPolicy = ctx.Config.Image.Strip.Policy
+	}
+	if req.StripPolicy == "all" {
+		// empty is all, so that keys of requests without strip policy stay the same.
+		req.StripPolicy = ""
+	}
+	if v, ok := r.Form["cs"]; ok && (v[0] == "srgb" || v[0] == "p3" || v[0] == "none") {
+		req.ColorSpace = v[0]
+	} else {
+		req.ColorSpace = ctx.Config.Image.ColorSpace
+	}
+	if req.ColorSpace == "srgb" {
+		// empty is srgb, so that keys of requests without color space stay the same.
+		req.ColorSpace = ""
+	}
+	if v, ok := r.Form["icc"]; ok {
+		req.KeepICC = v[0] != "0"
+	}
 	return &req
 }
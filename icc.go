@@ -0,0 +1,179 @@
+package kimg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"unicode/utf16"
+)
+
+// iccSRGB and iccDisplayP3 are the bundled matrix/TRC profiles colour managed images converted to.
+var (
+	iccSRGB = iccProfile("sRGB IEC61966-2.1", [3][3]float64{
+		{0.4360747, 0.2225045, 0.0139322},
+		{0.3850649, 0.7168786, 0.0971045},
+		{0.1430804, 0.0606169, 0.7141733},
+	})
+	iccDisplayP3 = iccProfile("Display P3", [3][3]float64{
+		{0.5151215, 0.2411957, -0.0010500},
+		{0.2919769, 0.6922455, 0.0418778},
+		{0.1571167, 0.0665588, 0.7843475},
+	})
+)
+
+// iccProfile build a ICC v2 display profile of rgb primaries adapted to D50, with the sRGB tone curve.
+func iccProfile(desc string, primaries [3][3]float64) []byte {
+	type tag struct {
+		sig  string
+		data []byte
+	}
+
+	xyz := func(x, y, z float64) []byte {
+		var b bytes.Buffer
+		b.WriteString("XYZ ")
+		binary.Write(&b, binary.BigEndian, uint32(0))
+		for _, v := range []float64{x, y, z} {
+			binary.Write(&b, binary.BigEndian, int32(math.Round(v*65536)))
+		}
+		return b.Bytes()
+	}
+
+	var descData bytes.Buffer
+	descData.WriteString("desc")
+	binary.Write(&descData, binary.BigEndian, uint32(0))
+	binary.Write(&descData, binary.BigEndian, uint32(len(desc)+1))
+	descData.WriteString(desc)
+	descData.Write(make([]byte, 1+4+4+2+1+67))
+
+	var cprtData bytes.Buffer
+	cprtData.WriteString("text")
+	binary.Write(&cprtData, binary.BigEndian, uint32(0))
+	cprtData.WriteString("No copyright, use freely")
+	cprtData.WriteByte(0)
+
+	var trcData bytes.Buffer
+	trcData.WriteString("curv")
+	binary.Write(&trcData, binary.BigEndian, uint32(0))
+	binary.Write(&trcData, binary.BigEndian, uint32(1024))
+	for i := 0; i < 1024; i++ {
+		v := float64(i) / 1023
+		if v <= 0.04045 {
+			v /= 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		binary.Write(&trcData, binary.BigEndian, uint16(math.Round(v*65535)))
+	}
+
+	tags := []tag{
+		{"desc", descData.Bytes()},
+		{"cprt", cprtData.Bytes()},
+		{"wtpt", xyz(0.9642, 1.0, 0.8249)},
+		{"rXYZ", xyz(primaries[0][0], primaries[0][1], primaries[0][2])},
+		{"gXYZ", xyz(primaries[1][0], primaries[1][1], primaries[1][2])},
+		{"bXYZ", xyz(primaries[2][0], primaries[2][1], primaries[2][2])},
+		{"rTRC", trcData.Bytes()},
+		{"gTRC", trcData.Bytes()},
+		{"bTRC", trcData.Bytes()},
+	}
+
+	var table, data bytes.Buffer
+	offset := 128 + 4 + 12*len(tags)
+	trcOffset := 0
+	binary.Write(&table, binary.BigEndian, uint32(len(tags)))
+	for _, t := range tags {
+		pos := offset + data.Len()
+		if strings.HasSuffix(t.sig, "TRC") {
+			if trcOffset == 0 {
+				trcOffset = pos
+				data.Write(t.data)
+			}
+			pos = trcOffset
+		} else {
+			data.Write(t.data)
+		}
+		table.WriteString(t.sig)
+		binary.Write(&table, binary.BigEndian, uint32(pos))
+		binary.Write(&table, binary.BigEndian, uint32(len(t.data)))
+		for data.Len()%4 != 0 {
+			data.WriteByte(0)
+		}
+	}
+
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[0:], uint32(offset+data.Len()))
+	binary.BigEndian.PutUint32(header[8:], 0x02100000)
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB ")
+	copy(header[20:], "XYZ ")
+	for i, v := range []uint16{2022, 1, 1} {
+		binary.BigEndian.PutUint16(header[24+i*2:], v)
+	}
+	copy(header[36:], "acsp")
+	for i, v := range []float64{0.9642, 1.0, 0.8249} {
+		binary.BigEndian.PutUint32(header[68+i*4:], uint32(int32(math.Round(v*65536))))
+	}
+
+	return append(append(header, table.Bytes()...), data.Bytes()...)
+}
+
+// iccDescription return the description of a ICC profile, from v2 desc or v4 mluc tag.
+func iccDescription(profile []byte) string {
+	if len(profile) < 132 {
+		return ""
+	}
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < count && 132+i*12+12 <= len(profile); i++ {
+		entry := profile[132+i*12:]
+		if string(entry[:4]) != "desc" {
+			continue
+		}
+		offset := int(binary.BigEndian.Uint32(entry[4:]))
+		size := int(binary.BigEndian.Uint32(entry[8:]))
+		if offset < 0 || size < 12 || offset+size > len(profile) {
+			return ""
+		}
+		data := profile[offset : offset+size]
+		switch string(data[:4]) {
+		case "desc":
+			n := int(binary.BigEndian.Uint32(data[8:]))
+			if n > len(data)-12 {
+				n = len(data) - 12
+			}
+			return strings.TrimRight(string(data[12:12+n]), "\x00")
+		case "mluc":
+			if len(data) < 28 {
+				return ""
+			}
+			n := int(binary.BigEndian.Uint32(data[20:]))
+			pos := int(binary.BigEndian.Uint32(data[24:]))
+			if pos+n > len(data) {
+				return ""
+			}
+			u := make([]uint16, n/2)
+			for j := range u {
+				u[j] = binary.BigEndian.Uint16(data[pos+j*2:])
+			}
+			return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+		}
+		return ""
+	}
+	return ""
+}
+
+// iccColorSpace return the colour space signature of a ICC profile, such as "RGB" or "CMYK".
+func iccColorSpace(profile []byte) string {
+	if len(profile) < 20 {
+		return ""
+	}
+	return strings.TrimSpace(string(profile[16:20]))
+}
+
+func isSRGBProfile(desc string) bool {
+	return strings.Contains(strings.ToLower(desc), "srgb")
+}
+
+func isP3Profile(desc string) bool {
+	return strings.Contains(strings.ToLower(desc), "p3")
+}
@@ -1,11 +1,15 @@
 package kimg
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math"
-	"net/url"
+	"os"
+	"sort"
 	"strings"
+	"sync"
 
 	"gopkg.in/gographics/imagick.v3/imagick"
 )
@@ -22,6 +26,30 @@ var orientationNames = map[imagick.OrientationType]string{
 	imagick.ORIENTATION_LEFT_BOTTOM:  "LEFT_BOTTOM",
 }
 
+var colorSpaceNames = map[imagick.ColorspaceType]string{
+	imagick.COLORSPACE_UNDEFINED: "UNDEFINED",
+	imagick.COLORSPACE_SRGB:      "SRGB",
+	imagick.COLORSPACE_RGB:       "RGB",
+	imagick.COLORSPACE_SCRGB:     "SCRGB",
+	imagick.COLORSPACE_GRAY:      "GRAY",
+	imagick.COLORSPACE_CMY:       "CMY",
+	imagick.COLORSPACE_CMYK:      "CMYK",
+	imagick.COLORSPACE_LAB:       "LAB",
+	imagick.COLORSPACE_YCBCR:     "YCBCR",
+	imagick.COLORSPACE_YCC:       "YCC",
+	imagick.COLORSPACE_XYZ:       "XYZ",
+}
+
+var stripPolicies = map[string]bool{
+	"all":            true,
+	"gps-only":       true,
+	"keep-copyright": true,
+	"keep-list":      true,
+}
+
+// watermarkTileMin is the min size of cells of tiled watermark.
+const watermarkTileMin = 32
+
 var gravityMaps = map[string]imagick.GravityType{
 	"nw": imagick.GRAVITY_NORTH_WEST,
 	"n":  imagick.GRAVITY_NORTH,
@@ -37,6 +65,15 @@ var gravityMaps = map[string]imagick.GravityType{
 // KimgImagick image processor struct hold kimg context.
 type KimgImagick struct {
 	ctx *KimgContext
+
+	logoMtx sync.Mutex
+	logos   map[string]*kimgLogo
+}
+
+// kimgLogo a decoded watermark logo with the version of its source.
+type kimgLogo struct {
+	version string
+	mw      *imagick.MagickWand
 }
 
 // NewKimgImagick create a image processor instance and initialize imagick.
@@ -44,15 +81,34 @@ func NewKimgImagick(ctx *KimgContext) *KimgImagick {
 	imagick.Initialize()
 
 	return &KimgImagick{
-		ctx: ctx,
+		ctx:   ctx,
+		logos: make(map[string]*kimgLogo),
 	}
 }
 
 // Release terminate imagick.
 func (image *KimgImagick) Release() {
+	image.logoMtx.Lock()
+	for source, logo := range image.logos {
+		logo.mw.Destroy()
+		delete(image.logos, source)
+	}
+	image.logoMtx.Unlock()
+
 	imagick.Terminate()
 }
 
+// DropLogo remove a decoded watermark logo from memory.
+func (image *KimgImagick) DropLogo(source string) {
+	image.logoMtx.Lock()
+	defer image.logoMtx.Unlock()
+
+	if logo, ok := image.logos[source]; ok {
+		logo.mw.Destroy()
+		delete(image.logos, source)
+	}
+}
+
 // Info get a image information and return a kimg response.
 func (image *KimgImagick) Info(req *KimgRequest, data []byte) (*KimgResponse, error) {
 	mw := imagick.NewMagickWand()
@@ -82,11 +138,35 @@ func (image *KimgImagick) Info(req *KimgRequest, data []byte) (*KimgResponse, er
 		exif[name] = mw.GetImageProperty(name)
 	}
 
-	u, _ := url.Parse(image.ctx.Config.Httpd.URL)
-	u.Path = fmt.Sprintf("image/%s", req.Md5)
+	colorSpace, ok := colorSpaceNames[mw.GetImageColorspace()]
+	if !ok {
+		colorSpace = "OTHER"
+	}
+
+	var gps *KimgGPS
+	lat, latOk := parseGPSCoord(exif["exif:GPSLatitude"], exif["exif:GPSLatitudeRef"])
+	lon, lonOk := parseGPSCoord(exif["exif:GPSLongitude"], exif["exif:GPSLongitudeRef"])
+	if latOk && lonOk {
+		gps = &KimgGPS{Latitude: lat, Longitude: lon}
+		if alt, ok := parseRational(exif["exif:GPSAltitude"]); ok {
+			if "1" == exif["exif:GPSAltitudeRef"] {
+				alt = -alt
+			}
+			gps.Altitude = &alt
+		}
+	}
+
+	var iptc, xmp map[string]string
+	if profile := mw.GetImageProfile("iptc"); len(profile) > 0 {
+		iptc = iptcFields([]byte(profile))
+	}
+	if profile := mw.GetImageProfile("xmp"); len(profile) > 0 {
+		xmp, _ = xmpFields([]byte(profile))
+	}
+
 	return &KimgResponse{
 		Md5:         req.Md5,
-		URL:         u.String(),
+		URL:         image.ctx.imageURL(req.Md5),
 		Style:       req.Key(),
 		Size:        int(size),
 		Width:       int(width),
@@ -94,9 +174,234 @@ func (image *KimgImagick) Info(req *KimgRequest, data []byte) (*KimgResponse, er
 		Format:      format,
 		Orientation: orientationNames[orientationType],
 		Exif:        exif,
+		ColorSpace:  colorSpace,
+		ICCProfile:  iccDescription([]byte(mw.GetImageProfile("icc"))),
+		IPTC:        iptc,
+		XMP:         xmp,
+		GPS:         gps,
 	}, nil
 }
 
+// Placeholder compute the blurhash and base64 encoded thumbhash of a image.
+func (image *KimgImagick) Placeholder(data []byte) (string, string, error) {
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	if err := mw.ReadImageBlob(data); err != nil {
+		image.ctx.Logger.Warn("ReadImageBlob err: %s", err)
+		return "", "", err
+	}
+	mw.SetIteratorIndex(0)
+
+	if err := mw.AutoOrientImage(); err != nil {
+		image.ctx.Logger.Warn("AutoOrientImage err: %s", err)
+		return "", "", err
+	}
+
+	w := mw.GetImageWidth()
+	h := mw.GetImageHeight()
+	if ratio := 100.0 / math.Max(float64(w), float64(h)); ratio < 1 {
+		w = uint(maxInt(1, round(float64(w)*ratio)))
+		h = uint(maxInt(1, round(float64(h)*ratio)))
+		if err := mw.ThumbnailImage(w, h); err != nil {
+			image.ctx.Logger.Warn("ThumbnailImage %d %d, err: %s", w, h, err)
+			return "", "", err
+		}
+	}
+
+	pixels, err := mw.ExportImagePixels(0, 0, w, h, "RGBA", imagick.PIXEL_CHAR)
+	if err != nil {
+		image.ctx.Logger.Warn("ExportImagePixels %d %d, err: %s", w, h, err)
+		return "", "", err
+	}
+	rgba := pixels.([]byte)
+
+	return blurHash(4, 3, int(w), int(h), rgba), base64.StdEncoding.EncodeToString(thumbHash(int(w), int(h), rgba)), nil
+}
+
+// PHash compute the 64 bits difference hash (dHash) of a image.
+func (image *KimgImagick) PHash(data []byte) (uint64, error) {
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	if err := mw.ReadImageBlob(data); err != nil {
+		image.ctx.Logger.Warn("ReadImageBlob err: %s", err)
+		return 0, err
+	}
+	mw.SetIteratorIndex(0)
+
+	if err := mw.AutoOrientImage(); err != nil {
+		image.ctx.Logger.Warn("AutoOrientImage err: %s", err)
+		return 0, err
+	}
+	if err := mw.ResizeImage(9, 8, imagick.FILTER_BOX); err != nil {
+		image.ctx.Logger.Warn("ResizeImage 9 8, err: %s", err)
+		return 0, err
+	}
+
+	pixels, err := mw.ExportImagePixels(0, 0, 9, 8, "I", imagick.PIXEL_CHAR)
+	if err != nil {
+		image.ctx.Logger.Warn("ExportImagePixels 9 8, err: %s", err)
+		return 0, err
+	}
+	gray := pixels.([]byte)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if gray[y*9+x] < gray[y*9+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// TrimBox detect the box left after trimming uniform borders of a image with fuzz percent.
+func (image *KimgImagick) TrimBox(data []byte, fuzz int) (*KimgTrimBox, error) {
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	if err := mw.ReadImageBlob(data); err != nil {
+		image.ctx.Logger.Warn("ReadImageBlob err: %s", err)
+		return nil, err
+	}
+	mw.SetIteratorIndex(0)
+
+	if err := mw.TrimImage(trimFuzz(fuzz)); err != nil {
+		image.ctx.Logger.Warn("TrimImage %d, err: %s", fuzz, err)
+		return nil, err
+	}
+
+	_, _, x, y, err := mw.GetImagePage()
+	if err != nil {
+		image.ctx.Logger.Warn("GetImagePage err: %s", err)
+		return nil, err
+	}
+
+	return &KimgTrimBox{
+		X:      x,
+		Y:      y,
+		Width:  int(mw.GetImageWidth()),
+		Height: int(mw.GetImageHeight()),
+	}, nil
+}
+
+// DetectMark extract the invisible watermark payload from a image, with the confidence of detection.
+func (image *KimgImagick) DetectMark(data []byte) (string, float64, error) {
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	if err := mw.ReadImageBlob(data); err != nil {
+		image.ctx.Logger.Warn("ReadImageBlob err: %s", err)
+		return "", 0, err
+	}
+	mw.SetIteratorIndex(0)
+
+	w := mw.GetImageWidth()
+	h := mw.GetImageHeight()
+	pixels, err := mw.ExportImagePixels(0, 0, w, h, "RGB", imagick.PIXEL_CHAR)
+	if err != nil {
+		image.ctx.Logger.Warn("ExportImagePixels %d %d, err: %s", w, h, err)
+		return "", 0, err
+	}
+
+	payload, confidence, err := detectMark(int(w), int(h), pixels.([]byte), image.ctx.Config.Mark.Key, float64(image.ctx.Config.Mark.Strength))
+	if err != nil {
+		image.ctx.Logger.Debug("detectMark confidence: %.2f, err: %s", confidence, err)
+		return "", confidence, err
+	}
+	image.ctx.Logger.Debug("detectMark %s, confidence: %.2f", payload, confidence)
+	return string(payload), confidence, nil
+}
+
+// Palette quantize a image to n colors and return its palette, average color and transparency.
+func (image *KimgImagick) Palette(data []byte, n int) (*KimgPalette, error) {
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	if err := mw.ReadImageBlob(data); err != nil {
+		image.ctx.Logger.Warn("ReadImageBlob err: %s", err)
+		return nil, err
+	}
+	mw.SetIteratorIndex(0)
+
+	w := mw.GetImageWidth()
+	h := mw.GetImageHeight()
+	if ratio := 200.0 / math.Max(float64(w), float64(h)); ratio < 1 {
+		w = uint(maxInt(1, round(float64(w)*ratio)))
+		h = uint(maxInt(1, round(float64(h)*ratio)))
+		if err := mw.ThumbnailImage(w, h); err != nil {
+			image.ctx.Logger.Warn("ThumbnailImage %d %d, err: %s", w, h, err)
+			return nil, err
+		}
+	}
+
+	pixels, err := mw.ExportImagePixels(0, 0, w, h, "RGBA", imagick.PIXEL_CHAR)
+	if err != nil {
+		image.ctx.Logger.Warn("ExportImagePixels %d %d, err: %s", w, h, err)
+		return nil, err
+	}
+	rgba := pixels.([]byte)
+
+	var sumR, sumG, sumB, sumA float64
+	transparent := 0
+	for i := 0; i+3 < len(rgba); i += 4 {
+		alpha := float64(rgba[i+3]) / 255
+		sumR += alpha * float64(rgba[i]) / 255
+		sumG += alpha * float64(rgba[i+1]) / 255
+		sumB += alpha * float64(rgba[i+2]) / 255
+		sumA += alpha
+		if alpha < 0.95 {
+			transparent++
+		}
+	}
+
+	palette := &KimgPalette{
+		Transparent: float64(transparent) > 0.01*float64(w*h),
+		Colors:      make([]*KimgPaletteColor, 0, n),
+	}
+	if sumA > 0 {
+		palette.Average = hexColor(sumR/sumA, sumG/sumA, sumB/sumA)
+	}
+
+	if err := mw.QuantizeImage(uint(n), imagick.COLORSPACE_SRGB, 0, imagick.DITHER_METHOD_NO, false); err != nil {
+		image.ctx.Logger.Warn("QuantizeImage %d, err: %s", n, err)
+		return nil, err
+	}
+	image.ctx.Logger.Debug("QuantizeImage %d", n)
+
+	total := 0
+	counts := make(map[string]int)
+	_, pws := mw.GetImageHistogram()
+	for _, pw := range pws {
+		if pw.GetAlpha() > 0 {
+			color := hexColor(pw.GetRed(), pw.GetGreen(), pw.GetBlue())
+			counts[color] += int(pw.GetColorCount())
+			total += int(pw.GetColorCount())
+		}
+		pw.Destroy()
+	}
+	for color, count := range counts {
+		palette.Colors = append(palette.Colors, &KimgPaletteColor{
+			Color:      color,
+			Proportion: float64(count) / float64(total),
+		})
+	}
+	sort.Slice(palette.Colors, func(i, j int) bool {
+		if palette.Colors[i].Proportion == palette.Colors[j].Proportion {
+			return palette.Colors[i].Color < palette.Colors[j].Color
+		}
+		return palette.Colors[i].Proportion > palette.Colors[j].Proportion
+	})
+	if len(palette.Colors) > 0 {
+		palette.Dominant = palette.Colors[0].Color
+	}
+
+	return palette, nil
+}
+
 // Convert convert a image according kimg request and return new image data.
 func (image *KimgImagick) Convert(data []byte, req KimgRequest) ([]byte, error) {
 	mw := imagick.NewMagickWand()
@@ -118,6 +423,14 @@ func (image *KimgImagick) Convert(data []byte, req KimgRequest) ([]byte, error)
 		image.ctx.Logger.Debug("SetImageFormat %s", req.Format)
 	}
 
+	if (req.Radius > 0 || req.Circle) && isSameFormat(mw.GetImageFormat(), "jpeg") {
+		if err = mw.SetImageFormat("PNG"); err != nil {
+			image.ctx.Logger.Warn("SetImageFormat PNG, err: %s", err)
+			return nil, err
+		}
+		image.ctx.Logger.Debug("SetImageFormat PNG for transparency")
+	}
+
 	if req.AutoOrient {
 		if err := mw.AutoOrientImage(); err != nil {
 			image.ctx.Logger.Warn("AutoOrientImage err: %s", err)
@@ -126,12 +439,23 @@ func (image *KimgImagick) Convert(data []byte, req KimgRequest) ([]byte, error)
 		image.ctx.Logger.Debug("AutoOrientImage")
 	}
 
+	profile, err := image.colorManage(mw, &req)
+	if err != nil {
+		return nil, err
+	}
+
 	if req.Strip {
-		if err := mw.StripImage(); err != nil {
-			image.ctx.Logger.Warn("StripImage err: %s", err)
+		if err := image.strip(mw, req.StripPolicy); err != nil {
 			return nil, err
 		}
-		image.ctx.Logger.Debug("StripImage")
+
+		if len(profile) > 0 {
+			if err := mw.SetImageProfile("icc", profile); err != nil {
+				image.ctx.Logger.Warn("SetImageProfile icc, err: %s", err)
+				return nil, err
+			}
+			image.ctx.Logger.Debug("SetImageProfile icc %s", iccDescription(profile))
+		}
 	}
 
 	var newData []byte
@@ -144,11 +468,13 @@ func (image *KimgImagick) Convert(data []byte, req KimgRequest) ([]byte, error)
 
 		mw = imagick.NewMagickWand()
 		mw.SetImageDelay(delay)
+		req.smartWindow = &kimgSmartWindow{}
 		for i := 0; i < int(aw.GetNumberImages()); i++ {
 			aw.SetIteratorIndex(i)
 			img := aw.GetImage()
 			defer img.Destroy()
-			if err = image.convertImage(img, &req); err == nil {
+			frameReq := req
+			if err = image.convertImage(img, &frameReq); err == nil {
 				mw.AddImage(img)
 			}
 		}
@@ -167,10 +493,148 @@ func (image *KimgImagick) Convert(data []byte, req KimgRequest) ([]byte, error)
 		return nil, errors.New("GetImageBlob failed")
 	}
 
+	if req.LQIP {
+		contentType := contentTypes[strings.ToLower(format)]
+		newData = []byte(fmt.Sprintf("data:%s;base64,%s", contentType, base64.StdEncoding.EncodeToString(newData)))
+	}
+
 	return newData, nil
 }
 
+// strip remove image metadata according to policy, empty or "all" remove all,
+// "gps-only" remove GPS from EXIF and XMP, "keep-copyright" and "keep-list" remove all but the kept fields.
+func (image *KimgImagick) strip(mw *imagick.MagickWand, policy string) error {
+	exif := []byte(mw.GetImageProfile("exif"))
+	iptc := []byte(mw.GetImageProfile("iptc"))
+	xmp := []byte(mw.GetImageProfile("xmp"))
+
+	if "gps-only" == policy {
+		if len(exif) > 0 {
+			data, err := filterExif(exif, func(ifd int, tag uint16) bool { return ifd != exifIFDGPS })
+			if err != nil {
+				image.ctx.Logger.Warn("filterExif gps, err: %s", err)
+				return err
+			}
+			if err := mw.SetImageProfile("exif", data); err != nil {
+				image.ctx.Logger.Warn("SetImageProfile exif, err: %s", err)
+				return err
+			}
+		}
+		if len(xmp) > 0 {
+			if err := mw.SetImageProfile("xmp", stripXMPGPS(xmp)); err != nil {
+				image.ctx.Logger.Warn("SetImageProfile xmp, err: %s", err)
+				return err
+			}
+		}
+		image.ctx.Logger.Debug("StripImage gps")
+		return nil
+	}
+
+	if err := mw.StripImage(); err != nil {
+		image.ctx.Logger.Warn("StripImage err: %s", err)
+		return err
+	}
+	image.ctx.Logger.Debug("StripImage %s", policy)
+
+	var keep []string
+	switch policy {
+	case "keep-copyright":
+		keep = stripKeepCopyright
+	case "keep-list":
+		keep = image.ctx.Config.Image.Strip.Keep
+	default:
+		return nil
+	}
+	names := make(map[string]bool)
+	for _, name := range keep {
+		names[strings.TrimPrefix(name, "exif:")] = true
+	}
+
+	profiles := make(map[string][]byte)
+	if len(exif) > 0 {
+		if data, err := filterExif(exif, exifKeep(names)); err == nil {
+			profiles["exif"] = data
+		} else {
+			image.ctx.Logger.Warn("filterExif err: %s", err)
+		}
+	}
+	if len(iptc) > 0 {
+		profiles["iptc"] = filterIPTC(iptc, names)
+	}
+	if len(xmp) > 0 {
+		profiles["xmp"] = filterXMP(xmp, names)
+	}
+	for name, data := range profiles {
+		if len(data) == 0 {
+			continue
+		}
+		if err := mw.SetImageProfile(name, data); err != nil {
+			image.ctx.Logger.Warn("SetImageProfile %s, err: %s", name, err)
+			return err
+		}
+		image.ctx.Logger.Debug("SetImageProfile %s", name)
+	}
+	return nil
+}
+
+// colorManage convert CMYK and wide-gamut images to sRGB, or Display P3 if requested, with ICC profiles,
+// empty color space is sRGB.
+// it returns the ICC profile which must be kept in output when stripping.
+func (image *KimgImagick) colorManage(mw *imagick.MagickWand, req *KimgRequest) ([]byte, error) {
+	profile := []byte(mw.GetImageProfile("icc"))
+	if "none" == req.ColorSpace {
+		if req.KeepICC {
+			return profile, nil
+		}
+		return nil, nil
+	}
+
+	desc := iccDescription(profile)
+	// the colour space of embedded profile is checked too, as the image colour space may be mislabeled.
+	cmyk := mw.GetImageColorspace() == imagick.COLORSPACE_CMYK || "CMYK" == iccColorSpace(profile)
+	if !cmyk && (len(profile) == 0 || isSRGBProfile(desc)) {
+		if req.KeepICC {
+			return profile, nil
+		}
+		return nil, nil
+	}
+	if "p3" == req.ColorSpace && isP3Profile(desc) {
+		image.ctx.Logger.Debug("colorManage keep %s", desc)
+		return profile, nil
+	}
+
+	target := iccSRGB
+	if "p3" == req.ColorSpace {
+		target = iccDisplayP3
+	}
+	if len(profile) == 0 {
+		if err := mw.TransformImageColorspace(imagick.COLORSPACE_SRGB); err != nil {
+			image.ctx.Logger.Warn("TransformImageColorspace sRGB, err: %s", err)
+			return nil, err
+		}
+		image.ctx.Logger.Debug("TransformImageColorspace CMYK to sRGB")
+		target = iccSRGB
+	} else {
+		if err := mw.ProfileImage("icc", target); err != nil {
+			image.ctx.Logger.Warn("ProfileImage %s to %s, err: %s", desc, iccDescription(target), err)
+			return nil, err
+		}
+		image.ctx.Logger.Debug("ProfileImage %s to %s", desc, iccDescription(target))
+	}
+
+	if req.KeepICC || "p3" == req.ColorSpace {
+		return target, nil
+	}
+	return nil, nil
+}
+
 func (image *KimgImagick) convertImage(mw *imagick.MagickWand, req *KimgRequest) error {
+	if req.Trim {
+		if err := image.trim(mw, req); err != nil {
+			return err
+		}
+	}
+
 	if req.Scale {
 		if err := image.scale(mw, req); err != nil {
 			return err
@@ -183,26 +647,38 @@ func (image *KimgImagick) convertImage(mw *imagick.MagickWand, req *KimgRequest)
 		}
 	}
 
-	if req.Rotate != 0 {
-		background := imagick.NewPixelWand()
-		defer background.Destroy()
-		if len(req.BGColor) == 0 {
-			req.BGColor = "transparent"
+	if req.Flip {
+		if err := mw.FlipImage(); err != nil {
+			image.ctx.Logger.Warn("FlipImage err: %s", err)
+			return err
 		}
-		if !background.SetColor(req.BGColor) {
-			image.ctx.Logger.Warn("background.SetColor %s failed", req.BGColor)
-		} else {
-			image.ctx.Logger.Debug("background.SetColor %s", req.BGColor)
+		image.ctx.Logger.Debug("FlipImage")
+	}
+
+	if req.Flop {
+		if err := mw.FlopImage(); err != nil {
+			image.ctx.Logger.Warn("FlopImage err: %s", err)
+			return err
 		}
-		if err := mw.RotateImage(background, float64(req.Rotate)); err != nil {
-			image.ctx.Logger.Warn("RotateImage %f, err: %s", req.Rotate, err)
+		image.ctx.Logger.Debug("FlopImage")
+	}
+
+	if req.Rotate != 0 {
+		if err := image.rotate(mw, req); err != nil {
 			return err
 		}
-		image.ctx.Logger.Debug("RotateImage %d %s", req.Rotate, req.BGColor)
 	}
 
-	if image.ctx.Config.Watermark.Enable {
-		if err := image.waterMark(mw); err != nil {
+	if err := image.adjust(mw, req); err != nil {
+		return err
+	}
+
+	if err := image.decorate(mw, req); err != nil {
+		return err
+	}
+
+	if wm := image.watermarkProfile(req); wm != nil {
+		if err := image.waterMark(mw, wm); err != nil {
 			return err
 		}
 	}
@@ -215,6 +691,12 @@ func (image *KimgImagick) convertImage(mw *imagick.MagickWand, req *KimgRequest)
 		image.ctx.Logger.Debug("SetImageType gray")
 	}
 
+	if len(req.Mark) > 0 {
+		if err := image.mark(mw, req.Mark); err != nil {
+			return err
+		}
+	}
+
 	if req.Quality > 0 {
 		if err := mw.SetImageCompressionQuality(uint(req.Quality)); err != nil {
 			image.ctx.Logger.Warn("SetImageCompressionQuality %d, err: %s", req.Quality, err)
@@ -225,9 +707,52 @@ func (image *KimgImagick) convertImage(mw *imagick.MagickWand, req *KimgRequest)
 	return nil
 }
 
+func (image *KimgImagick) trim(mw *imagick.MagickWand, req *KimgRequest) error {
+	border, err := mw.GetImagePixelColor(0, 0)
+	if err != nil {
+		image.ctx.Logger.Warn("GetImagePixelColor 0 0, err: %s", err)
+		return err
+	}
+	defer border.Destroy()
+
+	if err := mw.TrimImage(trimFuzz(req.TrimFuzz)); err != nil {
+		image.ctx.Logger.Warn("TrimImage %d, err: %s", req.TrimFuzz, err)
+		return err
+	}
+	w := mw.GetImageWidth()
+	h := mw.GetImageHeight()
+	if err := mw.SetImagePage(w, h, 0, 0); err != nil {
+		image.ctx.Logger.Warn("SetImagePage %d %d %d %d, err: %s", w, h, 0, 0, err)
+		return err
+	}
+	image.ctx.Logger.Debug("TrimImage %d %d %d", req.TrimFuzz, w, h)
+
+	if req.TrimPad > 0 {
+		if err := mw.SetImageBackgroundColor(border); err != nil {
+			image.ctx.Logger.Warn("SetImageBackgroundColor err: %s", err)
+			return err
+		}
+		pw := w + uint(2*req.TrimPad)
+		ph := h + uint(2*req.TrimPad)
+		if err := mw.ExtentImage(pw, ph, -req.TrimPad, -req.TrimPad); err != nil {
+			image.ctx.Logger.Warn("ExtentImage %d %d %d %d, err: %s", pw, ph, -req.TrimPad, -req.TrimPad, err)
+			return err
+		}
+		image.ctx.Logger.Debug("ExtentImage %d %d %d %d", pw, ph, -req.TrimPad, -req.TrimPad)
+	}
+	return nil
+}
+
+// trimFuzz convert fuzz percent to quantum range.
+func trimFuzz(fuzz int) float64 {
+	_, quantumRange := imagick.GetQuantumRange()
+	return float64(quantumRange) * float64(fuzz) / 100.0
+}
+
 func (image *KimgImagick) scale(mw *imagick.MagickWand, req *KimgRequest) error {
 	w := mw.GetImageWidth()
 	h := mw.GetImageHeight()
+	fillW, fillH := req.ScaleW, req.ScaleH
 
 	if req.ScaleP > 0 {
 		req.ScaleW = round(float64(w) * float64(req.ScaleP) / 100.0)
@@ -277,6 +802,20 @@ func (image *KimgImagick) scale(mw *imagick.MagickWand, req *KimgRequest) error
 		return err
 	}
 	image.ctx.Logger.Debug("ResizeImage %d %d", req.ScaleW, req.ScaleH)
+
+	if req.Focal && req.ScaleM == "fill" && fillW > 0 && fillH > 0 && (fillW < req.ScaleW || fillH < req.ScaleH) {
+		x, y := focalWindow(req.FocalX, req.FocalY, req.ScaleW, req.ScaleH, fillW, fillH)
+		if err := mw.CropImage(uint(fillW), uint(fillH), x, y); err != nil {
+			image.ctx.Logger.Warn("CropImage %d %d %d %d, err: %s", fillW, fillH, x, y, err)
+			return err
+		}
+		if err := mw.SetImagePage(uint(fillW), uint(fillH), 0, 0); err != nil {
+			image.ctx.Logger.Warn("SetImagePage %d %d %d %d, err: %s", fillW, fillH, 0, 0, err)
+			return err
+		}
+		req.ScaleW, req.ScaleH = fillW, fillH
+		image.ctx.Logger.Debug("CropImage focal %d %d %d %d", fillW, fillH, x, y)
+	}
 	return nil
 }
 
@@ -352,6 +891,25 @@ func (image *KimgImagick) crop(mw *imagick.MagickWand, req *KimgRequest) error {
 			x -= req.CropW
 			y -= req.CropH
 		}
+	case "smart", "entropy", "attention":
+		{
+			if req.smartWindow != nil && req.smartWindow.found {
+				x = maxInt(0, minInt(req.smartWindow.x, int(w)-req.CropW))
+				y = maxInt(0, minInt(req.smartWindow.y, int(h)-req.CropH))
+			} else {
+				var err error
+				if x, y, err = image.smartCrop(mw, req.Gravity, req.CropW, req.CropH); err != nil {
+					return err
+				}
+				if req.smartWindow != nil {
+					*req.smartWindow = kimgSmartWindow{x: x, y: y, found: true}
+				}
+			}
+		}
+	}
+
+	if req.Focal {
+		x, y = focalWindow(req.FocalX, req.FocalY, int(w), int(h), req.CropW, req.CropH)
 	}
 
 	switch req.Offset {
@@ -389,16 +947,419 @@ func (image *KimgImagick) crop(mw *imagick.MagickWand, req *KimgRequest) error {
 	return nil
 }
 
-func (image *KimgImagick) waterMark(mw *imagick.MagickWand) error {
+func (image *KimgImagick) rotate(mw *imagick.MagickWand, req *KimgRequest) error {
+	w := mw.GetImageWidth()
+	h := mw.GetImageHeight()
 
-	wm := image.ctx.Config.Watermark
-	if len(wm.Logo.File) > 0 {
-		logoMW := imagick.NewMagickWand()
-		defer logoMW.Destroy()
-		if err := logoMW.ReadImage(wm.Logo.File); err != nil {
-			image.ctx.Logger.Warn("ReadImage %s, err: %s", wm.Logo.File, err)
+	background := imagick.NewPixelWand()
+	defer background.Destroy()
+	if len(req.BGColor) == 0 {
+		req.BGColor = "transparent"
+	}
+	if !background.SetColor(req.BGColor) {
+		image.ctx.Logger.Warn("background.SetColor %s failed", req.BGColor)
+	} else {
+		image.ctx.Logger.Debug("background.SetColor %s", req.BGColor)
+	}
+	if err := mw.RotateImage(background, req.Rotate); err != nil {
+		image.ctx.Logger.Warn("RotateImage %f, err: %s", req.Rotate, err)
+		return err
+	}
+	image.ctx.Logger.Debug("RotateImage %f %s", req.Rotate, req.BGColor)
+
+	if req.RotateM == "crop" {
+		cw, ch := inscribedRect(float64(w), float64(h), req.Rotate*math.Pi/180)
+		rw := mw.GetImageWidth()
+		rh := mw.GetImageHeight()
+		x := round((float64(rw) - cw) / 2.0)
+		y := round((float64(rh) - ch) / 2.0)
+		if err := mw.CropImage(uint(cw), uint(ch), x, y); err != nil {
+			image.ctx.Logger.Warn("CropImage %d %d %d %d, err: %s", uint(cw), uint(ch), x, y, err)
+			return err
+		}
+		if err := mw.SetImagePage(uint(cw), uint(ch), 0, 0); err != nil {
+			image.ctx.Logger.Warn("SetImagePage %d %d %d %d, err: %s", uint(cw), uint(ch), 0, 0, err)
+			return err
+		}
+		image.ctx.Logger.Debug("CropImage %d %d %d %d", uint(cw), uint(ch), x, y)
+	}
+	return nil
+}
+
+// inscribedRect return the size of the largest axis-aligned rectangle within a w * h rectangle rotated by angle.
+func inscribedRect(w, h, angle float64) (float64, float64) {
+	if w <= 0 || h <= 0 {
+		return 0, 0
+	}
+
+	long, short := w, h
+	if h > w {
+		long, short = h, w
+	}
+	sinA := math.Abs(math.Sin(angle))
+	cosA := math.Abs(math.Cos(angle))
+
+	var cw, ch float64
+	if short <= 2*sinA*cosA*long || math.Abs(sinA-cosA) < 1e-10 {
+		x := 0.5 * short
+		if w >= h {
+			cw, ch = x/sinA, x/cosA
+		} else {
+			cw, ch = x/cosA, x/sinA
+		}
+	} else {
+		cos2A := cosA*cosA - sinA*sinA
+		cw, ch = (w*cosA-h*sinA)/cos2A, (h*cosA-w*sinA)/cos2A
+	}
+	return math.Max(1, math.Floor(cw)), math.Max(1, math.Floor(ch))
+}
+
+// adjust apply adjustment filters in order: normalize, auto level, brightness/contrast,
+// saturation/hue, gamma, blur, sharpen, sepia and negate.
+func (image *KimgImagick) adjust(mw *imagick.MagickWand, req *KimgRequest) error {
+	if req.Normalize {
+		if err := mw.NormalizeImage(); err != nil {
+			image.ctx.Logger.Warn("NormalizeImage err: %s", err)
+			return err
+		}
+		image.ctx.Logger.Debug("NormalizeImage")
+	}
+
+	if req.AutoLevel {
+		if err := mw.AutoLevelImage(); err != nil {
+			image.ctx.Logger.Warn("AutoLevelImage err: %s", err)
+			return err
+		}
+		image.ctx.Logger.Debug("AutoLevelImage")
+	}
+
+	if req.Brightness != 0 || req.Contrast != 0 {
+		if err := mw.BrightnessContrastImage(float64(req.Brightness), float64(req.Contrast)); err != nil {
+			image.ctx.Logger.Warn("BrightnessContrastImage %d %d, err: %s", req.Brightness, req.Contrast, err)
+			return err
+		}
+		image.ctx.Logger.Debug("BrightnessContrastImage %d %d", req.Brightness, req.Contrast)
+	}
+
+	if req.Saturation != 0 || req.Hue != 0 {
+		if err := mw.ModulateImage(100, float64(100+req.Saturation), float64(100+req.Hue)); err != nil {
+			image.ctx.Logger.Warn("ModulateImage 100 %d %d, err: %s", 100+req.Saturation, 100+req.Hue, err)
+			return err
+		}
+		image.ctx.Logger.Debug("ModulateImage 100 %d %d", 100+req.Saturation, 100+req.Hue)
+	}
+
+	if req.Gamma > 0 {
+		if err := mw.GammaImage(req.Gamma); err != nil {
+			image.ctx.Logger.Warn("GammaImage %f, err: %s", req.Gamma, err)
+			return err
+		}
+		image.ctx.Logger.Debug("GammaImage %f", req.Gamma)
+	}
+
+	if req.Blur > 0 {
+		if err := mw.GaussianBlurImage(0, req.Blur); err != nil {
+			image.ctx.Logger.Warn("GaussianBlurImage %f, err: %s", req.Blur, err)
+			return err
+		}
+		image.ctx.Logger.Debug("GaussianBlurImage %f", req.Blur)
+	}
+
+	if req.Sharpen > 0 {
+		if err := mw.UnsharpMaskImage(0, req.Sharpen, 1.0, 0.05); err != nil {
+			image.ctx.Logger.Warn("UnsharpMaskImage %f, err: %s", req.Sharpen, err)
+			return err
+		}
+		image.ctx.Logger.Debug("UnsharpMaskImage %f", req.Sharpen)
+	}
+
+	if req.Sepia > 0 {
+		_, quantumRange := imagick.GetQuantumRange()
+		if err := mw.SepiaToneImage(float64(quantumRange) * float64(req.Sepia) / 100.0); err != nil {
+			image.ctx.Logger.Warn("SepiaToneImage %d, err: %s", req.Sepia, err)
+			return err
+		}
+		image.ctx.Logger.Debug("SepiaToneImage %d", req.Sepia)
+	}
+
+	if req.Negate {
+		if err := mw.NegateImage(false); err != nil {
+			image.ctx.Logger.Warn("NegateImage err: %s", err)
+			return err
+		}
+		image.ctx.Logger.Debug("NegateImage")
+	}
+	return nil
+}
+
+// decorate apply padding, mask with rounded corners or circle, and border.
+func (image *KimgImagick) decorate(mw *imagick.MagickWand, req *KimgRequest) error {
+	if req.Pad && req.PadW > 0 && req.PadH > 0 {
+		w := int(mw.GetImageWidth())
+		h := int(mw.GetImageHeight())
+
+		background := imagick.NewPixelWand()
+		defer background.Destroy()
+		color := req.BGColor
+		if len(color) == 0 {
+			color = "transparent"
+			if isSameFormat(mw.GetImageFormat(), "jpeg") {
+				color = "white"
+			}
+		}
+		background.SetColor(color)
+		if err := mw.SetImageBackgroundColor(background); err != nil {
+			image.ctx.Logger.Warn("SetImageBackgroundColor %s, err: %s", color, err)
+			return err
+		}
+
+		x := -round(float64(req.PadW-w) / 2.0)
+		y := -round(float64(req.PadH-h) / 2.0)
+		if err := mw.ExtentImage(uint(req.PadW), uint(req.PadH), x, y); err != nil {
+			image.ctx.Logger.Warn("ExtentImage %d %d %d %d, err: %s", req.PadW, req.PadH, x, y, err)
 			return err
 		}
+		image.ctx.Logger.Debug("ExtentImage %d %d %d %d %s", req.PadW, req.PadH, x, y, color)
+	}
+
+	if req.Circle || req.Radius > 0 {
+		return image.mask(mw, req)
+	}
+
+	if req.BorderW > 0 {
+		border := imagick.NewPixelWand()
+		defer border.Destroy()
+		border.SetColor(req.BorderColor)
+		if err := mw.BorderImage(border, uint(req.BorderW), uint(req.BorderW), imagick.COMPOSITE_OP_OVER); err != nil {
+			image.ctx.Logger.Warn("BorderImage %d %s, err: %s", req.BorderW, req.BorderColor, err)
+			return err
+		}
+		image.ctx.Logger.Debug("BorderImage %d %s", req.BorderW, req.BorderColor)
+	}
+	return nil
+}
+
+// mask make pixels outside rounded rectangle or circle transparent, border is stroked along the shape.
+func (image *KimgImagick) mask(mw *imagick.MagickWand, req *KimgRequest) error {
+	w := int(mw.GetImageWidth())
+	h := int(mw.GetImageHeight())
+
+	if req.Circle && w != h {
+		size := minInt(w, h)
+		x := (w - size) / 2
+		y := (h - size) / 2
+		if err := mw.CropImage(uint(size), uint(size), x, y); err != nil {
+			image.ctx.Logger.Warn("CropImage %d %d %d %d, err: %s", size, size, x, y, err)
+			return err
+		}
+		if err := mw.SetImagePage(uint(size), uint(size), 0, 0); err != nil {
+			image.ctx.Logger.Warn("SetImagePage %d %d %d %d, err: %s", size, size, 0, 0, err)
+			return err
+		}
+		w, h = size, size
+	}
+
+	if err := mw.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_SET); err != nil {
+		image.ctx.Logger.Warn("SetImageAlphaChannel err: %s", err)
+		return err
+	}
+
+	drawShape := func(dw *imagick.DrawingWand, inset float64) {
+		if req.Circle {
+			c := float64(w-1) / 2.0
+			dw.Circle(c, c, c, inset)
+		} else {
+			r := float64(req.Radius)
+			dw.RoundRectangle(inset, inset, float64(w-1)-inset, float64(h-1)-inset, r, r)
+		}
+	}
+
+	maskMW := imagick.NewMagickWand()
+	dw := imagick.NewDrawingWand()
+	pw := imagick.NewPixelWand()
+	defer maskMW.Destroy()
+	defer dw.Destroy()
+	defer pw.Destroy()
+
+	pw.SetColor("transparent")
+	if err := maskMW.NewImage(uint(w), uint(h), pw); err != nil {
+		image.ctx.Logger.Warn("NewImage %d %d, err: %s", w, h, err)
+		return err
+	}
+	pw.SetColor("white")
+	dw.SetFillColor(pw)
+	drawShape(dw, 0)
+	if err := maskMW.DrawImage(dw); err != nil {
+		image.ctx.Logger.Warn("DrawImage mask err: %s", err)
+		return err
+	}
+	if err := mw.CompositeImage(maskMW, imagick.COMPOSITE_OP_DST_IN, true, 0, 0); err != nil {
+		image.ctx.Logger.Warn("CompositeImage mask err: %s", err)
+		return err
+	}
+	image.ctx.Logger.Debug("CompositeImage mask circle: %t, radius: %d", req.Circle, req.Radius)
+
+	if req.BorderW > 0 {
+		bdw := imagick.NewDrawingWand()
+		fill := imagick.NewPixelWand()
+		stroke := imagick.NewPixelWand()
+		defer bdw.Destroy()
+		defer fill.Destroy()
+		defer stroke.Destroy()
+
+		fill.SetColor("none")
+		stroke.SetColor(req.BorderColor)
+		bdw.SetFillColor(fill)
+		bdw.SetStrokeColor(stroke)
+		bdw.SetStrokeWidth(float64(req.BorderW))
+		drawShape(bdw, float64(req.BorderW)/2.0)
+		if err := mw.DrawImage(bdw); err != nil {
+			image.ctx.Logger.Warn("DrawImage border %d %s, err: %s", req.BorderW, req.BorderColor, err)
+			return err
+		}
+		image.ctx.Logger.Debug("DrawImage border %d %s", req.BorderW, req.BorderColor)
+	}
+	return nil
+}
+
+// focalWindow return the top left position of a cw * ch window centred on focal point (fx, fy)
+// in a w * h image, clamped to image bounds.
+func focalWindow(fx, fy float64, w, h, cw, ch int) (int, int) {
+	x := round(fx*float64(w) - float64(cw)/2.0)
+	y := round(fy*float64(h) - float64(ch)/2.0)
+	x = maxInt(0, minInt(x, w-cw))
+	y = maxInt(0, minInt(y, h-ch))
+	return x, y
+}
+
+func (image *KimgImagick) smartCrop(mw *imagick.MagickWand, strategy string, cw, ch int) (int, int, error) {
+	w := int(mw.GetImageWidth())
+	h := int(mw.GetImageHeight())
+
+	aw := mw.Clone()
+	defer aw.Destroy()
+
+	ratio := math.Min(1, 256.0/math.Max(float64(w), float64(h)))
+	sw := maxInt(1, round(float64(w)*ratio))
+	sh := maxInt(1, round(float64(h)*ratio))
+	if ratio < 1 {
+		if err := aw.ThumbnailImage(uint(sw), uint(sh)); err != nil {
+			image.ctx.Logger.Warn("ThumbnailImage %d %d, err: %s", sw, sh, err)
+			return 0, 0, err
+		}
+	}
+
+	pixels, err := aw.ExportImagePixels(0, 0, uint(sw), uint(sh), "RGB", imagick.PIXEL_CHAR)
+	if err != nil {
+		image.ctx.Logger.Warn("ExportImagePixels %d %d, err: %s", sw, sh, err)
+		return 0, 0, err
+	}
+
+	scw := maxInt(1, round(float64(cw)*ratio))
+	sch := maxInt(1, round(float64(ch)*ratio))
+	sx, sy := smartCropWindow(strategy, sw, sh, pixels.([]byte), scw, sch)
+
+	x := maxInt(0, minInt(round(float64(sx)/ratio), w-cw))
+	y := maxInt(0, minInt(round(float64(sy)/ratio), h-ch))
+	image.ctx.Logger.Debug("smartCrop %s %d %d %d %d", strategy, cw, ch, x, y)
+	return x, y, nil
+}
+
+// watermarkProfile resolve the watermark of a request from named profiles and inline params.
+func (image *KimgImagick) watermarkProfile(req *KimgRequest) *KimgWatermark {
+	var wm KimgWatermark
+	if req.Watermark == "default" {
+		wm = image.ctx.Config.Watermark.KimgWatermark
+	} else if profile, ok := image.ctx.Config.Watermark.Profiles[req.Watermark]; ok {
+		wm = *profile
+	} else if len(req.WatermarkText) > 0 {
+		wm = image.ctx.Config.Watermark.KimgWatermark
+	} else {
+		return nil
+	}
+
+	if len(req.WatermarkText) > 0 {
+		wm.Text.Content = req.WatermarkText
+		wm.Logo.File = ""
+		wm.Logo.Md5 = ""
+	}
+	if req.WatermarkSize > 0 {
+		wm.Text.FontSize = req.WatermarkSize
+	}
+	if len(req.WatermarkColor) > 0 {
+		wm.Text.FontColor = req.WatermarkColor
+	}
+	if len(req.WatermarkGravity) > 0 {
+		wm.Gravity = req.WatermarkGravity
+	}
+	return &wm
+}
+
+// logo return a copy of the decoded watermark logo, which is read from kimg by md5 or from file,
+// and kept in memory until its source changes.
+func (image *KimgImagick) logo(wm *KimgWatermark) (*imagick.MagickWand, error) {
+	source := "md5:" + wm.Logo.Md5
+	version := ""
+	if len(wm.Logo.Md5) == 0 {
+		fi, err := os.Stat(wm.Logo.File)
+		if err != nil {
+			image.ctx.Logger.Warn("Stat %s, err: %s", wm.Logo.File, err)
+			return nil, err
+		}
+		source = "file:" + wm.Logo.File
+		version = fmt.Sprintf("%d:%d", fi.ModTime().UnixNano(), fi.Size())
+	}
+
+	image.logoMtx.Lock()
+	if logo, ok := image.logos[source]; ok && logo.version == version {
+		logoMW := logo.mw.Clone()
+		image.logoMtx.Unlock()
+		return logoMW, nil
+	}
+	image.logoMtx.Unlock()
+
+	var data []byte
+	var err error
+	if len(wm.Logo.Md5) > 0 {
+		data, err = image.ctx.GetImage(image.ctx.originRequest(wm.Logo.Md5))
+	} else {
+		data, err = ioutil.ReadFile(wm.Logo.File)
+	}
+	if err != nil {
+		image.ctx.Logger.Warn("read logo %s, err: %s", source, err)
+		return nil, err
+	}
+
+	logoMW := imagick.NewMagickWand()
+	if err := logoMW.ReadImageBlob(data); err != nil {
+		logoMW.Destroy()
+		image.ctx.Logger.Warn("ReadImageBlob logo %s, err: %s", source, err)
+		return nil, err
+	}
+	image.ctx.Logger.Debug("decode logo %s", source)
+
+	image.logoMtx.Lock()
+	defer image.logoMtx.Unlock()
+	if logo, ok := image.logos[source]; ok {
+		logo.mw.Destroy()
+	}
+	image.logos[source] = &kimgLogo{version: version, mw: logoMW}
+	return logoMW.Clone(), nil
+}
+
+func (image *KimgImagick) waterMark(mw *imagick.MagickWand, wm *KimgWatermark) error {
+	if wm.Tile.Enable {
+		return image.tileWaterMark(mw, wm)
+	}
+
+	if len(wm.Logo.File) > 0 || len(wm.Logo.Md5) > 0 {
+		logoMW, err := image.logo(wm)
+		if err != nil {
+			return err
+		}
+		defer logoMW.Destroy()
+
+		logoW, logoH := logoSize(mw, logoMW, wm)
 
 		dw := imagick.NewDrawingWand()
 		pw := imagick.NewPixelWand()
@@ -418,11 +1379,11 @@ func (image *KimgImagick) waterMark(mw *imagick.MagickWand) error {
 			image.ctx.Logger.Debug("Rotate %d", wm.Rotate)
 		}
 
-		if err := dw.Composite(imagick.COMPOSITE_OP_OVER, float64(wm.X), float64(wm.Y), float64(wm.Logo.W), float64(wm.Logo.H), logoMW); err != nil {
-			image.ctx.Logger.Warn("Composite %d %d %d %d, err: %s", wm.X, wm.Y, wm.Logo.W, wm.Logo.H, err)
+		if err := dw.Composite(imagick.COMPOSITE_OP_OVER, float64(wm.X), float64(wm.Y), float64(logoW), float64(logoH), logoMW); err != nil {
+			image.ctx.Logger.Warn("Composite %d %d %d %d, err: %s", wm.X, wm.Y, logoW, logoH, err)
 			return err
 		}
-		image.ctx.Logger.Debug("Composite %d %d %d %d", wm.X, wm.Y, wm.Logo.W, wm.Logo.H)
+		image.ctx.Logger.Debug("Composite %d %d %d %d", wm.X, wm.Y, logoW, logoH)
 
 		if err := mw.DrawImage(dw); err != nil {
 			image.ctx.Logger.Warn("DrawImage err: %s", err)
@@ -441,51 +1402,234 @@ func (image *KimgImagick) waterMark(mw *imagick.MagickWand) error {
 			dw.SetGravity(gravity)
 			image.ctx.Logger.Debug("SetGravity %s", wm.Gravity)
 		}
-		if len(wm.Text.FontName) > 0 {
-			if err := dw.SetFont(wm.Text.FontName); err != nil {
-				image.ctx.Logger.Warn("SetFont %s, err: %s", wm.Text.FontName, err)
-			} else {
-				image.ctx.Logger.Debug("SetFont %s", wm.Text.FontName)
-			}
+		image.textStyle(dw, pw, wm)
+		if err := mw.AnnotateImage(dw, float64(wm.X), float64(wm.Y), float64(wm.Rotate), wm.Text.Content); err != nil {
+			image.ctx.Logger.Warn("AnnotateImage %d %d %d %s, err: %s", wm.X, wm.Y, wm.Rotate, wm.Text.Content, err)
+			return err
 		}
-		if wm.Text.FontSize > 0 {
-			dw.SetFontSize(float64(wm.Text.FontSize))
-			image.ctx.Logger.Debug("SetFontSize %d", wm.Text.FontSize)
+		image.ctx.Logger.Debug("AnnotateImage %d %d %d %s", wm.X, wm.Y, wm.Rotate, wm.Text.Content)
+	}
+	return nil
+}
+
+func hexColor(r, g, b float64) string {
+	return fmt.Sprintf("#%02x%02x%02x", round(r*255), round(g*255), round(b*255))
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// mark embed the invisible watermark payload to image pixels.
+func (image *KimgImagick) mark(mw *imagick.MagickWand, payload string) error {
+	w := mw.GetImageWidth()
+	h := mw.GetImageHeight()
+	pixels, err := mw.ExportImagePixels(0, 0, w, h, "RGB", imagick.PIXEL_CHAR)
+	if err != nil {
+		image.ctx.Logger.Warn("ExportImagePixels %d %d, err: %s", w, h, err)
+		return err
+	}
+	rgb := pixels.([]byte)
+
+	if err := embedMark(int(w), int(h), rgb, []byte(payload), image.ctx.Config.Mark.Key, float64(image.ctx.Config.Mark.Strength)); err != nil {
+		image.ctx.Logger.Warn("embedMark %s, err: %s", payload, err)
+		return err
+	}
+
+	if err := mw.ImportImagePixels(0, 0, w, h, "RGB", imagick.PIXEL_CHAR, rgb); err != nil {
+		image.ctx.Logger.Warn("ImportImagePixels %d %d, err: %s", w, h, err)
+		return err
+	}
+	image.ctx.Logger.Debug("mark %s", payload)
+	return nil
+}
+
+// textStyle set font, fill and stroke of watermark text to drawing wand.
+func (image *KimgImagick) textStyle(dw *imagick.DrawingWand, pw *imagick.PixelWand, wm *KimgWatermark) {
+	if len(wm.Text.FontName) > 0 {
+		if err := dw.SetFont(wm.Text.FontName); err != nil {
+			image.ctx.Logger.Warn("SetFont %s, err: %s", wm.Text.FontName, err)
+		} else {
+			image.ctx.Logger.Debug("SetFont %s", wm.Text.FontName)
 		}
-		if len(wm.Text.FontColor) > 0 {
-			if pw.SetColor(wm.Text.FontColor) {
-				image.ctx.Logger.Debug("SetAlpha %d", wm.Opacity)
-				dw.SetFillColor(pw)
-				image.ctx.Logger.Debug("SetFillColor %s", wm.Text.FontColor)
+	}
+	if wm.Text.FontSize > 0 {
+		dw.SetFontSize(float64(wm.Text.FontSize))
+		image.ctx.Logger.Debug("SetFontSize %d", wm.Text.FontSize)
+	}
+	if len(wm.Text.FontColor) > 0 {
+		if pw.SetColor(wm.Text.FontColor) {
+			image.ctx.Logger.Debug("SetAlpha %d", wm.Opacity)
+			dw.SetFillColor(pw)
+			image.ctx.Logger.Debug("SetFillColor %s", wm.Text.FontColor)
+		} else {
+			image.ctx.Logger.Warn("SetFillColor %s, err", wm.Text.FontColor)
+		}
+	}
+	dw.SetFillOpacity(float64(wm.Opacity) / 100.0)
+	image.ctx.Logger.Debug("SetFillOpacity %d", wm.Opacity)
+	if wm.Text.StrokeWidth > 0 {
+		dw.SetStrokeWidth(float64(wm.Text.StrokeWidth))
+		image.ctx.Logger.Debug("SetStrokeWidth %d", wm.Text.StrokeWidth)
+		if len(wm.Text.StrokeColor) > 0 {
+			if pw.SetColor(wm.Text.StrokeColor) {
+				dw.SetStrokeColor(pw)
+				image.ctx.Logger.Debug("SetStrokeColor %s", wm.Text.StrokeColor)
 			} else {
-				image.ctx.Logger.Warn("SetFillColor %s, err", wm.Text.FontColor)
+				image.ctx.Logger.Warn("SetStrokeColor %s, err", wm.Text.StrokeColor)
 			}
 		}
-		dw.SetFillOpacity(float64(wm.Opacity) / 100.0)
-		image.ctx.Logger.Debug("SetFillOpacity %d", wm.Opacity)
-		if wm.Text.StrokeWidth > 0 {
-			dw.SetStrokeWidth(float64(wm.Text.StrokeWidth))
-			image.ctx.Logger.Debug("SetStrokeWidth %d", wm.Text.StrokeWidth)
-			if len(wm.Text.StrokeColor) > 0 {
-				if pw.SetColor(wm.Text.StrokeColor) {
-					dw.SetStrokeColor(pw)
-					image.ctx.Logger.Debug("SetStrokeColor %s", wm.Text.StrokeColor)
-				} else {
-					image.ctx.Logger.Warn("SetStrokeColor %s, err", wm.Text.StrokeColor)
-				}
-			}
-			dw.SetStrokeOpacity(float64(wm.Opacity) / 100.0)
-			image.ctx.Logger.Debug("SetStrokeOpacity %d", wm.Opacity)
+		dw.SetStrokeOpacity(float64(wm.Opacity) / 100.0)
+		image.ctx.Logger.Debug("SetStrokeOpacity %d", wm.Opacity)
+	}
+}
+
+// tileWaterMark repeat the watermark logo and text rotated by angle across the whole image.
+func (image *KimgImagick) tileWaterMark(mw *imagick.MagickWand, wm *KimgWatermark) error {
+	transparent := imagick.NewPixelWand()
+	defer transparent.Destroy()
+	transparent.SetColor("transparent")
+
+	spacing := maxInt(0, wm.Tile.Spacing)
+
+	if len(wm.Logo.File) > 0 || len(wm.Logo.Md5) > 0 {
+		logoMW, err := image.logo(wm)
+		if err != nil {
+			return err
 		}
-		if err := mw.AnnotateImage(dw, float64(wm.X), float64(wm.Y), float64(wm.Rotate), wm.Text.Content); err != nil {
-			image.ctx.Logger.Warn("AnnotateImage %d %d %d %s, err: %s", wm.X, wm.Y, wm.Rotate, wm.Text.Content, err)
+		defer logoMW.Destroy()
+
+		logoW, logoH := logoSize(mw, logoMW, wm)
+		if err := logoMW.ResizeImage(uint(logoW), uint(logoH), imagick.FILTER_LANCZOS); err != nil {
+			image.ctx.Logger.Warn("ResizeImage logo %d %d, err: %s", logoW, logoH, err)
+			return err
+		}
+		if wm.Opacity > 0 {
+			logoMW.SetImageAlpha(float64(wm.Opacity) / 100.0)
+			image.ctx.Logger.Debug("SetImageAlpha %d", wm.Opacity)
+		}
+
+		tile := imagick.NewMagickWand()
+		defer tile.Destroy()
+		if err := tile.NewImage(uint(logoW+spacing), uint(logoH+spacing), transparent); err != nil {
+			image.ctx.Logger.Warn("NewImage %d %d, err: %s", logoW+spacing, logoH+spacing, err)
+			return err
+		}
+		if err := tile.CompositeImage(logoMW, imagick.COMPOSITE_OP_OVER, true, spacing/2, spacing/2); err != nil {
+			image.ctx.Logger.Warn("CompositeImage logo tile err: %s", err)
+			return err
+		}
+		if err := image.tile(mw, tile, transparent, wm.Tile.Angle); err != nil {
+			return err
+		}
+	}
+
+	if len(wm.Text.Content) > 0 {
+		dw := imagick.NewDrawingWand()
+		pw := imagick.NewPixelWand()
+		defer dw.Destroy()
+		defer pw.Destroy()
+
+		image.textStyle(dw, pw, wm)
+		metrics := mw.QueryFontMetrics(dw, wm.Text.Content)
+		if metrics == nil {
+			image.ctx.Logger.Warn("QueryFontMetrics %s failed", wm.Text.Content)
+			return errors.New("QueryFontMetrics failed")
+		}
+		tw := int(math.Ceil(metrics.TextWidth)) + spacing
+		th := int(math.Ceil(metrics.TextHeight)) + spacing
+
+		tile := imagick.NewMagickWand()
+		defer tile.Destroy()
+		if err := tile.NewImage(uint(tw), uint(th), transparent); err != nil {
+			image.ctx.Logger.Warn("NewImage %d %d, err: %s", tw, th, err)
+			return err
+		}
+		dw.SetGravity(imagick.GRAVITY_CENTER)
+		if err := tile.AnnotateImage(dw, 0, 0, 0, wm.Text.Content); err != nil {
+			image.ctx.Logger.Warn("AnnotateImage tile %s, err: %s", wm.Text.Content, err)
+			return err
+		}
+		if err := image.tile(mw, tile, transparent, wm.Tile.Angle); err != nil {
 			return err
 		}
-		image.ctx.Logger.Debug("AnnotateImage %d %d %d %s", wm.X, wm.Y, wm.Rotate, wm.Text.Content)
 	}
 	return nil
 }
 
+// tile rotate the tile by angle and repeat it across the image in staggered rows.
+// A pattern of two rows is textured over a layer composited once, and cells are at least
+// watermarkTileMin pixels, so that tiny tiles do not cost a composite per cell.
+func (image *KimgImagick) tile(mw, tile *imagick.MagickWand, background *imagick.PixelWand, angle int) error {
+	if angle != 0 {
+		if err := tile.RotateImage(background, float64(angle)); err != nil {
+			image.ctx.Logger.Warn("RotateImage tile %d, err: %s", angle, err)
+			return err
+		}
+	}
+
+	w := mw.GetImageWidth()
+	h := mw.GetImageHeight()
+	tw := maxInt(watermarkTileMin, int(tile.GetImageWidth()))
+	th := maxInt(watermarkTileMin, int(tile.GetImageHeight()))
+
+	pattern := imagick.NewMagickWand()
+	defer pattern.Destroy()
+	if err := pattern.NewImage(uint(tw), uint(2*th), background); err != nil {
+		image.ctx.Logger.Warn("NewImage pattern %d %d, err: %s", tw, 2*th, err)
+		return err
+	}
+	for _, p := range [][2]int{{0, 0}, {-tw / 2, th}, {tw - tw/2, th}} {
+		if err := pattern.CompositeImage(tile, imagick.COMPOSITE_OP_OVER, true, p[0], p[1]); err != nil {
+			image.ctx.Logger.Warn("CompositeImage pattern %d %d, err: %s", p[0], p[1], err)
+			return err
+		}
+	}
+
+	layer := imagick.NewMagickWand()
+	defer layer.Destroy()
+	if err := layer.NewImage(w, h, background); err != nil {
+		image.ctx.Logger.Warn("NewImage layer %d %d, err: %s", w, h, err)
+		return err
+	}
+	textured := layer.TextureImage(pattern)
+	if textured == nil {
+		image.ctx.Logger.Warn("TextureImage %d %d failed", tw, th)
+		return errors.New("TextureImage failed")
+	}
+	defer textured.Destroy()
+
+	if err := mw.CompositeImage(textured, imagick.COMPOSITE_OP_OVER, true, 0, 0); err != nil {
+		image.ctx.Logger.Warn("CompositeImage tile layer err: %s", err)
+		return err
+	}
+	image.ctx.Logger.Debug("tile watermark %d %d %d", tw, th, angle)
+	return nil
+}
+
+// logoSize return the size of watermark logo, scaled relative to image width if configured.
+func logoSize(mw, logoMW *imagick.MagickWand, wm *KimgWatermark) (int, int) {
+	if wm.Logo.Scale > 0 {
+		logoW := maxInt(1, round(float64(mw.GetImageWidth())*float64(wm.Logo.Scale)/100.0))
+		logoH := maxInt(1, round(float64(logoW)*float64(logoMW.GetImageHeight())/float64(logoMW.GetImageWidth())))
+		return logoW, logoH
+	}
+	if wm.Logo.W <= 0 || wm.Logo.H <= 0 {
+		return int(logoMW.GetImageWidth()), int(logoMW.GetImageHeight())
+	}
+	return wm.Logo.W, wm.Logo.H
+}
+
 func round(x float64) int {
 	return int(math.Floor(x + 0.5))
 }
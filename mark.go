@@ -0,0 +1,209 @@
+package kimg
+
+import (
+	"errors"
+	"hash/crc32"
+	"hash/crc64"
+	"math"
+	"math/rand"
+)
+
+const (
+	// markGrid is the size of the luma grid the invisible watermark is embedded in,
+	// images are resampled to it so that the mark survives resizing.
+	markGrid = 256
+	// markBlock is the size of DCT blocks in the grid.
+	markBlock = 8
+	// markPayload is the max length of invisible watermark payload in bytes.
+	markPayload = 8
+	// markBits is the number of bits of a frame: length, payload and the low 16 bits of crc32 as checksum.
+	markBits = (1 + markPayload + 2) * 8
+)
+
+// ErrNoWatermark returned when no invisible watermark is found in image.
+var ErrNoWatermark = errors.New("no watermark found")
+
+// embedMark embed payload into the mid-low frequency DCT coefficients of a w * h rgb image in place.
+// each bit of the frame is spread over the blocks of the grid by a permutation derived from key,
+// the relation of coefficients (1,2) and (2,1) of a block carries the bit with a margin of strength.
+func embedMark(w, h int, rgb []byte, payload []byte, key string, strength float64) error {
+	if len(payload) == 0 || len(payload) > markPayload {
+		return errors.New("invalid watermark payload length")
+	}
+	bits := markFrame(payload, key)
+	perm := markPerm(key)
+
+	grid := resampleLuma(lumaPixels(w, h, rgb), w, h, markGrid, markGrid)
+	delta := make([]float64, markGrid*markGrid)
+	n := markGrid / markBlock
+	for b := 0; b < n*n; b++ {
+		bx, by := (b%n)*markBlock, (b/n)*markBlock
+		c1 := dctCoef(grid, bx, by, 1, 2) * 255
+		c2 := dctCoef(grid, bx, by, 2, 1) * 255
+		target := strength
+		if bits[perm[b]%markBits] == 0 {
+			target = -strength
+		}
+		diff := c1 - c2
+		if (target > 0 && diff >= target) || (target < 0 && diff <= target) {
+			continue
+		}
+		d := (target - diff) / 2
+		for y := 0; y < markBlock; y++ {
+			for x := 0; x < markBlock; x++ {
+				delta[(by+y)*markGrid+bx+x] = d * (dctBasis(x, y, 1, 2) - dctBasis(x, y, 2, 1))
+			}
+		}
+	}
+
+	for y := 0; y < h; y++ {
+		gy := (float64(y)+0.5)*markGrid/float64(h) - 0.5
+		for x := 0; x < w; x++ {
+			gx := (float64(x)+0.5)*markGrid/float64(w) - 0.5
+			d := bilinear(delta, markGrid, markGrid, gx, gy)
+			p := (y*w + x) * 3
+			for c := 0; c < 3; c++ {
+				rgb[p+c] = byte(math.Max(0, math.Min(255, math.Round(float64(rgb[p+c])+d))))
+			}
+		}
+	}
+	return nil
+}
+
+// detectMark extract the payload embedded by embedMark from a w * h rgb image,
+// it returns the payload and the confidence, the mean margin of votes relative to strength.
+func detectMark(w, h int, rgb []byte, key string, strength float64) ([]byte, float64, error) {
+	perm := markPerm(key)
+	grid := resampleLuma(lumaPixels(w, h, rgb), w, h, markGrid, markGrid)
+
+	votes := make([]float64, markBits)
+	n := markGrid / markBlock
+	for b := 0; b < n*n; b++ {
+		bx, by := (b%n)*markBlock, (b/n)*markBlock
+		votes[perm[b]%markBits] += (dctCoef(grid, bx, by, 1, 2) - dctCoef(grid, bx, by, 2, 1)) * 255
+	}
+
+	bits := make([]byte, markBits)
+	margin := 0.0
+	for i, v := range votes {
+		if v > 0 {
+			bits[i] = 1
+		}
+		margin += math.Abs(v)
+	}
+	confidence := margin / float64(n*n) / strength
+
+	frame := make([]byte, markBits/8)
+	for i, bit := range bits {
+		frame[i/8] |= bit << (7 - uint(i%8))
+	}
+	stream := markStream(key)
+	for i := range frame {
+		frame[i] ^= stream[i]
+	}
+
+	size := int(frame[0])
+	if size == 0 || size > markPayload {
+		return nil, confidence, ErrNoWatermark
+	}
+	sum := crc32.ChecksumIEEE(frame[:1+markPayload])
+	if frame[1+markPayload] != byte(sum>>8) || frame[2+markPayload] != byte(sum) {
+		return nil, confidence, ErrNoWatermark
+	}
+	return frame[1 : 1+size], confidence, nil
+}
+
+// markFrame return the whitened bits of payload frame: length, zero padded payload
+// and the low 16 bits of crc32 as checksum.
+func markFrame(payload []byte, key string) []byte {
+	frame := make([]byte, markBits/8)
+	frame[0] = byte(len(payload))
+	copy(frame[1:], payload)
+	sum := crc32.ChecksumIEEE(frame[:1+markPayload])
+	frame[1+markPayload] = byte(sum >> 8)
+	frame[2+markPayload] = byte(sum)
+
+	stream := markStream(key)
+	bits := make([]byte, markBits)
+	for i := range bits {
+		bits[i] = ((frame[i/8] ^ stream[i/8]) >> (7 - uint(i%8))) & 1
+	}
+	return bits
+}
+
+func markRand(key string) *rand.Rand {
+	return rand.New(rand.NewSource(int64(crc64.Checksum([]byte(key), crc64.MakeTable(crc64.ECMA)))))
+}
+
+func markPerm(key string) []int {
+	n := markGrid / markBlock
+	return markRand(key).Perm(n * n)
+}
+
+func markStream(key string) []byte {
+	stream := make([]byte, markBits/8)
+	rnd := markRand("stream:" + key)
+	for i := range stream {
+		stream[i] = byte(rnd.Intn(256))
+	}
+	return stream
+}
+
+// resampleLuma resample a w * h luma image to dw * dh by area averaging.
+func resampleLuma(luma []float64, w, h, dw, dh int) []float64 {
+	dst := make([]float64, dw*dh)
+	sx := float64(w) / float64(dw)
+	sy := float64(h) / float64(dh)
+	for y := 0; y < dh; y++ {
+		y0, y1 := float64(y)*sy, float64(y+1)*sy
+		for x := 0; x < dw; x++ {
+			x0, x1 := float64(x)*sx, float64(x+1)*sx
+			sum, area := 0.0, 0.0
+			for j := int(y0); j < minInt(h, int(math.Ceil(y1))); j++ {
+				fy := math.Min(y1, float64(j+1)) - math.Max(y0, float64(j))
+				for i := int(x0); i < minInt(w, int(math.Ceil(x1))); i++ {
+					f := fy * (math.Min(x1, float64(i+1)) - math.Max(x0, float64(i)))
+					sum += f * luma[j*w+i]
+					area += f
+				}
+			}
+			if area > 0 {
+				dst[y*dw+x] = sum / area
+			}
+		}
+	}
+	return dst
+}
+
+func bilinear(src []float64, w, h int, x, y float64) float64 {
+	x = math.Max(0, math.Min(float64(w-1), x))
+	y = math.Max(0, math.Min(float64(h-1), y))
+	x0, y0 := int(x), int(y)
+	x1, y1 := minInt(w-1, x0+1), minInt(h-1, y0+1)
+	fx, fy := x-float64(x0), y-float64(y0)
+	top := src[y0*w+x0]*(1-fx) + src[y0*w+x1]*fx
+	bottom := src[y1*w+x0]*(1-fx) + src[y1*w+x1]*fx
+	return top*(1-fy) + bottom*fy
+}
+
+// dctCoef compute the (u,v) coefficient of the orthonormal DCT of the block at bx, by in grid.
+func dctCoef(grid []float64, bx, by, u, v int) float64 {
+	sum := 0.0
+	for y := 0; y < markBlock; y++ {
+		for x := 0; x < markBlock; x++ {
+			sum += grid[(by+y)*markGrid+bx+x] * dctBasis(x, y, u, v)
+		}
+	}
+	return sum
+}
+
+func dctBasis(x, y, u, v int) float64 {
+	au, av := math.Sqrt(2.0/markBlock), math.Sqrt(2.0/markBlock)
+	if u == 0 {
+		au = math.Sqrt(1.0 / markBlock)
+	}
+	if v == 0 {
+		av = math.Sqrt(1.0 / markBlock)
+	}
+	return au * av * math.Cos(float64(2*x+1)*float64(u)*math.Pi/(2*markBlock)) * math.Cos(float64(2*y+1)*float64(v)*math.Pi/(2*markBlock))
+}
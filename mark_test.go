@@ -0,0 +1,133 @@
+package kimg
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"testing"
+)
+
+// testRGB build a w * h rgb image of smooth gradients with a little noise.
+func testRGB(w, h int) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	rgb := make([]byte, w*h*3)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := (y*w + x) * 3
+			rgb[p] = byte(64 + 128*x/w + rnd.Intn(8))
+			rgb[p+1] = byte(64 + 128*y/h + rnd.Intn(8))
+			rgb[p+2] = byte(96 + rnd.Intn(8))
+		}
+	}
+	return rgb
+}
+
+// testDownscale shrink a w * h rgb image by factor n with box averaging.
+func testDownscale(w, h int, rgb []byte, n int) (int, int, []byte) {
+	dw, dh := w/n, h/n
+	dst := make([]byte, dw*dh*3)
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			for c := 0; c < 3; c++ {
+				sum := 0
+				for j := 0; j < n; j++ {
+					for i := 0; i < n; i++ {
+						sum += int(rgb[((y*n+j)*w+x*n+i)*3+c])
+					}
+				}
+				dst[(y*dw+x)*3+c] = byte(sum / (n * n))
+			}
+		}
+	}
+	return dw, dh, dst
+}
+
+func TestMark(t *testing.T) {
+	const w, h, strength = 512, 384, 16
+
+	for _, c := range []struct {
+		name      string
+		payload   string
+		key       string
+		detectKey string
+		scale     int
+		detected  bool
+	}{
+		{"round trip", "kimg", "kimg", "kimg", 1, true},
+		{"max payload", "12345678", "kimg", "kimg", 1, true},
+		{"single byte", "k", "secret", "secret", 1, true},
+		{"downscaled", "kimg", "kimg", "kimg", 2, true},
+		{"wrong key", "kimg", "kimg", "other", 1, false},
+	} {
+		rgb := testRGB(w, h)
+		if err := embedMark(w, h, rgb, []byte(c.payload), c.key, strength); err != nil {
+			t.Fatalf("%s: embedMark err: %s", c.name, err)
+		}
+		dw, dh := w, h
+		if c.scale > 1 {
+			dw, dh, rgb = testDownscale(w, h, rgb, c.scale)
+		}
+
+		payload, confidence, err := detectMark(dw, dh, rgb, c.detectKey, strength)
+		if !c.detected {
+			if !errors.Is(err, ErrNoWatermark) {
+				t.Errorf("%s: want ErrNoWatermark, got payload %q err %v", c.name, payload, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: detectMark err: %s, confidence: %f", c.name, err, confidence)
+			continue
+		}
+		if !bytes.Equal(payload, []byte(c.payload)) {
+			t.Errorf("%s: want payload %q, got %q", c.name, c.payload, payload)
+		}
+		if confidence < 0.5 {
+			t.Errorf("%s: confidence %f too low", c.name, confidence)
+		}
+	}
+}
+
+func TestMarkUnmarked(t *testing.T) {
+	const w, h, strength = 256, 256, 16
+
+	payload, confidence, err := detectMark(w, h, testRGB(w, h), "kimg", strength)
+	if !errors.Is(err, ErrNoWatermark) {
+		t.Errorf("want ErrNoWatermark, got payload %q err %v", payload, err)
+	}
+	if confidence >= 0.5 {
+		t.Errorf("confidence %f of unmarked image too high", confidence)
+	}
+
+	for _, payload := range []string{"", "123456789"} {
+		if err := embedMark(w, h, testRGB(w, h), []byte(payload), "kimg", strength); err == nil {
+			t.Errorf("payload %q of invalid length should be rejected", payload)
+		}
+	}
+}
+
+func TestMarkFrame(t *testing.T) {
+	bits := markFrame([]byte("kimg"), "kimg")
+	if len(bits) != markBits {
+		t.Fatalf("want %d bits, got %d", markBits, len(bits))
+	}
+
+	frame := make([]byte, markBits/8)
+	for i, bit := range bits {
+		frame[i/8] |= bit << (7 - uint(i%8))
+	}
+	stream := markStream("kimg")
+	for i := range frame {
+		frame[i] ^= stream[i]
+	}
+
+	want := append([]byte{4}, "kimg\x00\x00\x00\x00"...)
+	if !bytes.Equal(frame[:1+markPayload], want) {
+		t.Errorf("want length and padded payload %q, got %q", want, frame[:1+markPayload])
+	}
+	sum := crc32.ChecksumIEEE(want)
+	if frame[1+markPayload] != byte(sum>>8) || frame[2+markPayload] != byte(sum) {
+		t.Errorf("want checksum %04x, got %02x%02x", uint16(sum), frame[1+markPayload], frame[2+markPayload])
+	}
+}
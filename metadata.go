@@ -0,0 +1,534 @@
+package kimg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// exif ifd kinds of a tag.
+const (
+	exifIFD0 = iota
+	exifIFDExif
+	exifIFDGPS
+	exifIFDInterop
+)
+
+const (
+	exifTagExifIFD    = 0x8769
+	exifTagGPSIFD     = 0x8825
+	exifTagInteropIFD = 0xA005
+	exifTagMakerNote  = 0x927C
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+var exifTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4}
+
+var exifTagNames = map[uint16]string{
+	0x010E: "ImageDescription",
+	0x010F: "Make",
+	0x0110: "Model",
+	0x0112: "Orientation",
+	0x011A: "XResolution",
+	0x011B: "YResolution",
+	0x0128: "ResolutionUnit",
+	0x0131: "Software",
+	0x0132: "DateTime",
+	0x013B: "Artist",
+	0x8298: "Copyright",
+	0x829A: "ExposureTime",
+	0x829D: "FNumber",
+	0x8822: "ExposureProgram",
+	0x8827: "PhotographicSensitivity",
+	0x9000: "ExifVersion",
+	0x9003: "DateTimeOriginal",
+	0x9004: "DateTimeDigitized",
+	0x9010: "OffsetTime",
+	0x9011: "OffsetTimeOriginal",
+	0x9201: "ShutterSpeedValue",
+	0x9202: "ApertureValue",
+	0x9204: "ExposureBiasValue",
+	0x9207: "MeteringMode",
+	0x9209: "Flash",
+	0x920A: "FocalLength",
+	0x9286: "UserComment",
+	0xA001: "ColorSpace",
+	0xA002: "PixelXDimension",
+	0xA003: "PixelYDimension",
+	0xA402: "ExposureMode",
+	0xA403: "WhiteBalance",
+	0xA405: "FocalLengthIn35mmFilm",
+	0xA406: "SceneCaptureType",
+	0xA430: "CameraOwnerName",
+	0xA431: "BodySerialNumber",
+	0xA432: "LensSpecification",
+	0xA433: "LensMake",
+	0xA434: "LensModel",
+	0xA435: "LensSerialNumber",
+}
+
+var gpsTagNames = map[uint16]string{
+	0x00: "GPSVersionID",
+	0x01: "GPSLatitudeRef",
+	0x02: "GPSLatitude",
+	0x03: "GPSLongitudeRef",
+	0x04: "GPSLongitude",
+	0x05: "GPSAltitudeRef",
+	0x06: "GPSAltitude",
+	0x07: "GPSTimeStamp",
+	0x10: "GPSImgDirectionRef",
+	0x11: "GPSImgDirection",
+	0x12: "GPSMapDatum",
+	0x1D: "GPSDateStamp",
+}
+
+var iptcNames = map[uint8]string{
+	5:   "ObjectName",
+	15:  "Category",
+	20:  "SupplementalCategories",
+	25:  "Keywords",
+	40:  "SpecialInstructions",
+	55:  "DateCreated",
+	60:  "TimeCreated",
+	80:  "By-line",
+	85:  "By-lineTitle",
+	90:  "City",
+	92:  "Sub-location",
+	95:  "Province-State",
+	101: "Country-PrimaryLocationName",
+	103: "OriginalTransmissionReference",
+	105: "Headline",
+	110: "Credit",
+	115: "Source",
+	116: "CopyrightNotice",
+	118: "Contact",
+	120: "Caption-Abstract",
+	122: "Writer-Editor",
+}
+
+var xmpNamespaces = map[string]string{
+	"http://www.w3.org/1999/02/22-rdf-syntax-ns#": "rdf",
+	"http://purl.org/dc/elements/1.1/":            "dc",
+	"http://ns.adobe.com/xap/1.0/":                "xmp",
+	"http://ns.adobe.com/xap/1.0/rights/":         "xmpRights",
+	"http://ns.adobe.com/photoshop/1.0/":          "photoshop",
+	"http://ns.adobe.com/exif/1.0/":               "exif",
+	"http://ns.adobe.com/tiff/1.0/":               "tiff",
+	"http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/": "Iptc4xmpCore",
+}
+
+// stripKeepCopyright are the metadata fields kept by the keep-copyright strip policy.
+var stripKeepCopyright = []string{
+	"Artist", "Copyright",
+	"By-line", "By-lineTitle", "Credit", "Source", "CopyrightNotice", "Contact",
+	"dc:creator", "dc:rights", "xmpRights:Marked", "xmpRights:WebStatement", "xmpRights:UsageTerms",
+	"photoshop:Credit", "photoshop:Source",
+}
+
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// filterExif rewrite a exif profile with only the entries of IFD0, Exif, GPS and Interop IFDs kept by keep,
+// the thumbnail IFD and maker note are always dropped since they can not be relocated safely.
+func filterExif(profile []byte, keep func(ifd int, tag uint16) bool) ([]byte, error) {
+	prefix := []byte{}
+	data := profile
+	if bytes.HasPrefix(profile, exifHeader) {
+		prefix = exifHeader
+		data = profile[len(exifHeader):]
+	}
+	if len(data) < 8 {
+		return nil, errors.New("invalid exif")
+	}
+
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("invalid exif byte order")
+	}
+
+	readIFD := func(offset uint32) ([]*exifEntry, map[uint16]uint32) {
+		entries := make([]*exifEntry, 0)
+		pointers := make(map[uint16]uint32)
+		if offset == 0 || int(offset)+2 > len(data) {
+			return entries, pointers
+		}
+		n := int(order.Uint16(data[offset:]))
+		for i := 0; i < n; i++ {
+			p := int(offset) + 2 + i*12
+			if p+12 > len(data) {
+				break
+			}
+			e := &exifEntry{
+				tag:   order.Uint16(data[p:]),
+				typ:   order.Uint16(data[p+2:]),
+				count: order.Uint32(data[p+4:]),
+			}
+			size := exifTypeSizes[e.typ] * int(e.count)
+			if size <= 0 || size > len(data) {
+				continue
+			}
+			if size <= 4 {
+				e.value = data[p+8 : p+8+size]
+			} else {
+				o := int(order.Uint32(data[p+8:]))
+				if o < 0 || o+size > len(data) {
+					continue
+				}
+				e.value = data[o : o+size]
+			}
+			switch e.tag {
+			case exifTagExifIFD, exifTagGPSIFD, exifTagInteropIFD:
+				// a pointer must be a single LONG or IFD, malformed ones are dropped with their sub ifd.
+				if (e.typ == 4 || e.typ == 13) && e.count == 1 && len(e.value) == 4 {
+					pointers[e.tag] = order.Uint32(e.value)
+				}
+			default:
+				entries = append(entries, e)
+			}
+		}
+		return entries, pointers
+	}
+
+	var ifds [4][]*exifEntry
+	var pointers map[uint16]uint32
+	ifds[exifIFD0], pointers = readIFD(order.Uint32(data[4:]))
+	if offset, ok := pointers[exifTagExifIFD]; ok {
+		var sub map[uint16]uint32
+		ifds[exifIFDExif], sub = readIFD(offset)
+		if offset, ok := sub[exifTagInteropIFD]; ok {
+			ifds[exifIFDInterop], _ = readIFD(offset)
+		}
+	}
+	if offset, ok := pointers[exifTagGPSIFD]; ok {
+		ifds[exifIFDGPS], _ = readIFD(offset)
+	}
+
+	for ifd := range ifds {
+		kept := ifds[ifd][:0]
+		for _, e := range ifds[ifd] {
+			if e.tag != exifTagMakerNote && keep(ifd, e.tag) {
+				kept = append(kept, e)
+			}
+		}
+		ifds[ifd] = kept
+	}
+
+	// link sub ifds to their parents, the pointer values are set once layout is known.
+	link := func(parent int, tag uint16) *exifEntry {
+		e := &exifEntry{tag: tag, typ: 4, count: 1, value: make([]byte, 4)}
+		ifds[parent] = append(ifds[parent], e)
+		return e
+	}
+	var links [4]*exifEntry
+	if len(ifds[exifIFDInterop]) > 0 {
+		links[exifIFDInterop] = link(exifIFDExif, exifTagInteropIFD)
+	}
+	if len(ifds[exifIFDExif]) > 0 {
+		links[exifIFDExif] = link(exifIFD0, exifTagExifIFD)
+	}
+	if len(ifds[exifIFDGPS]) > 0 {
+		links[exifIFDGPS] = link(exifIFD0, exifTagGPSIFD)
+	}
+
+	ifdSize := func(entries []*exifEntry) int {
+		size := 2 + 12*len(entries) + 4
+		for _, e := range entries {
+			if len(e.value) > 4 {
+				size += len(e.value) + len(e.value)%2
+			}
+		}
+		return size
+	}
+
+	var offsets [4]int
+	offset := 8
+	for _, ifd := range []int{exifIFD0, exifIFDExif, exifIFDGPS, exifIFDInterop} {
+		if ifd != exifIFD0 && len(ifds[ifd]) == 0 {
+			continue
+		}
+		offsets[ifd] = offset
+		offset += ifdSize(ifds[ifd])
+		if links[ifd] != nil {
+			order.PutUint32(links[ifd].value, uint32(offsets[ifd]))
+		}
+	}
+
+	out := make([]byte, offset)
+	copy(out, data[:4])
+	order.PutUint32(out[4:], 8)
+	for ifd, entries := range ifds {
+		if ifd != exifIFD0 && len(entries) == 0 {
+			continue
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+		p := offsets[ifd]
+		extra := p + 2 + 12*len(entries) + 4
+		order.PutUint16(out[p:], uint16(len(entries)))
+		for i, e := range entries {
+			q := p + 2 + i*12
+			order.PutUint16(out[q:], e.tag)
+			order.PutUint16(out[q+2:], e.typ)
+			order.PutUint32(out[q+4:], e.count)
+			if len(e.value) <= 4 {
+				copy(out[q+8:], e.value)
+			} else {
+				order.PutUint32(out[q+8:], uint32(extra))
+				copy(out[extra:], e.value)
+				extra += len(e.value) + len(e.value)%2
+			}
+		}
+	}
+
+	return append(append([]byte{}, prefix...), out...), nil
+}
+
+// exifKeep return the keep function of filterExif for field names.
+func exifKeep(names map[string]bool) func(ifd int, tag uint16) bool {
+	return func(ifd int, tag uint16) bool {
+		if ifd == exifIFDGPS {
+			return names[gpsTagNames[tag]]
+		}
+		return names[exifTagNames[tag]]
+	}
+}
+
+type iptcDataset struct {
+	record  uint8
+	dataset uint8
+	value   []byte
+}
+
+// parseIPTC parse the datasets of a IPTC-IIM profile.
+func parseIPTC(profile []byte) []*iptcDataset {
+	datasets := make([]*iptcDataset, 0)
+	for p := 0; p+5 <= len(profile); {
+		if profile[p] != 0x1C {
+			p++
+			continue
+		}
+		size := int(binary.BigEndian.Uint16(profile[p+3:]))
+		if size&0x8000 != 0 || p+5+size > len(profile) {
+			break
+		}
+		datasets = append(datasets, &iptcDataset{
+			record:  profile[p+1],
+			dataset: profile[p+2],
+			value:   profile[p+5 : p+5+size],
+		})
+		p += 5 + size
+	}
+	return datasets
+}
+
+// filterIPTC rewrite a IPTC-IIM profile with only the application record datasets named in names.
+func filterIPTC(profile []byte, names map[string]bool) []byte {
+	var b bytes.Buffer
+	for _, d := range parseIPTC(profile) {
+		if d.record != 2 || (d.dataset != 0 && !names[iptcNames[d.dataset]]) {
+			continue
+		}
+		b.Write([]byte{0x1C, d.record, d.dataset})
+		binary.Write(&b, binary.BigEndian, uint16(len(d.value)))
+		b.Write(d.value)
+	}
+	if b.Len() <= 5 {
+		return nil
+	}
+	return b.Bytes()
+}
+
+// iptcFields return the application record datasets of a IPTC-IIM profile by name,
+// repeated datasets such as keywords are joined with comma.
+func iptcFields(profile []byte) map[string]string {
+	fields := make(map[string]string)
+	for _, d := range parseIPTC(profile) {
+		if d.record != 2 || d.dataset == 0 {
+			continue
+		}
+		name, ok := iptcNames[d.dataset]
+		if !ok {
+			name = fmt.Sprintf("2:%d", d.dataset)
+		}
+		if v, ok := fields[name]; ok {
+			fields[name] = v + ", " + string(d.value)
+		} else {
+			fields[name] = string(d.value)
+		}
+	}
+	return fields
+}
+
+// xmpFields return the properties of a XMP packet as prefix:name, array items are joined with comma.
+func xmpFields(profile []byte) (map[string]string, map[string]string) {
+	fields := make(map[string]string)
+	namespaces := make(map[string]string)
+	prefixes := make(map[string]string)
+	for uri, prefix := range xmpNamespaces {
+		prefixes[uri] = prefix
+	}
+	name := func(n xml.Name) string {
+		if prefix, ok := prefixes[n.Space]; ok {
+			namespaces[prefix] = n.Space
+			return prefix + ":" + n.Local
+		}
+		return n.Local
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(profile))
+	depth, property := 0, ""
+	var values []string
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" {
+					if _, ok := prefixes[attr.Value]; !ok {
+						prefixes[attr.Value] = attr.Name.Local
+					}
+				}
+			}
+			if depth > 0 {
+				depth++
+				text.Reset()
+				continue
+			}
+			if name(t.Name) == "rdf:Description" {
+				for _, attr := range t.Attr {
+					if attr.Name.Space == "xmlns" || attr.Name.Space == "" {
+						continue
+					}
+					if n := name(attr.Name); n != "rdf:about" {
+						fields[n] = attr.Value
+					}
+				}
+				continue
+			}
+			if prefixes[t.Name.Space] != "rdf" && prefixes[t.Name.Space] != "x" && t.Name.Space != "adobe:ns:meta/" {
+				property = name(t.Name)
+				values = values[:0]
+				depth = 1
+				text.Reset()
+			}
+		case xml.CharData:
+			if depth > 0 {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			if depth == 0 {
+				continue
+			}
+			if v := strings.TrimSpace(text.String()); len(v) > 0 {
+				values = append(values, v)
+			}
+			text.Reset()
+			depth--
+			if depth == 0 && len(values) > 0 {
+				fields[property] = strings.Join(values, ", ")
+			}
+		}
+	}
+	return fields, namespaces
+}
+
+// filterXMP build a minimal XMP packet with only the properties named in names.
+func filterXMP(profile []byte, names map[string]bool) []byte {
+	fields, namespaces := xmpFields(profile)
+	keys := make([]string, 0)
+	for key := range fields {
+		if names[key] && strings.Contains(key, ":") {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>")
+	b.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">`)
+	b.WriteString(`<rdf:Description rdf:about=""`)
+	declared := make(map[string]bool)
+	for _, key := range keys {
+		prefix := key[:strings.Index(key, ":")]
+		if !declared[prefix] {
+			declared[prefix] = true
+			b.WriteString(fmt.Sprintf(` xmlns:%s="`, prefix))
+			xml.EscapeText(&b, []byte(namespaces[prefix]))
+			b.WriteString(`"`)
+		}
+	}
+	for _, key := range keys {
+		b.WriteString(fmt.Sprintf(` %s="`, key))
+		xml.EscapeText(&b, []byte(fields[key]))
+		b.WriteString(`"`)
+	}
+	b.WriteString(`/></rdf:RDF></x:xmpmeta><?xpacket end="w"?>`)
+	return b.Bytes()
+}
+
+var (
+	xmpGPSAttr    = regexp.MustCompile(`\s+exif:GPS\w+="[^"]*"`)
+	xmpGPSElement = regexp.MustCompile(`(?s)<exif:GPS\w+\s*/>|<exif:(GPS\w+)[^>]*>.*?</exif:GPS\w+>`)
+)
+
+// stripXMPGPS remove the exif GPS properties from a XMP packet.
+func stripXMPGPS(profile []byte) []byte {
+	profile = xmpGPSAttr.ReplaceAll(profile, nil)
+	return xmpGPSElement.ReplaceAll(profile, nil)
+}
+
+// parseGPSCoord decode a exif GPS coordinate such as "52/1, 30/1, 1234/100" with its ref to degrees.
+func parseGPSCoord(value, ref string) (float64, bool) {
+	parts := strings.Split(value, ",")
+	if len(parts) == 0 || len(parts) > 3 {
+		return 0, false
+	}
+	degrees := 0.0
+	for i, part := range parts {
+		v, ok := parseRational(part)
+		if !ok {
+			return 0, false
+		}
+		degrees += v / []float64{1, 60, 3600}[i]
+	}
+	if ref == "S" || ref == "W" {
+		degrees = -degrees
+	}
+	return degrees, true
+}
+
+func parseRational(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, "/"); i >= 0 {
+		n, err1 := strconv.ParseFloat(s[:i], 64)
+		d, err2 := strconv.ParseFloat(s[i+1:], 64)
+		if err1 != nil || err2 != nil || d == 0 {
+			return 0, false
+		}
+		return n / d, true
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	return v, err == nil
+}
@@ -0,0 +1,98 @@
+package kimg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testExif build a little endian exif profile with Artist in IFD0,
+// and a ExifIFD pointer entry of typ and count pointing to a sub ifd with DateTimeOriginal.
+func testExif(typ uint16, count uint32) []byte {
+	le := binary.LittleEndian
+	var b bytes.Buffer
+	b.WriteString("II")
+	binary.Write(&b, le, uint16(42))
+	binary.Write(&b, le, uint32(8))
+
+	// IFD0 at 8: 2 entries, sub ifd at 8+2+24+4 = 38.
+	binary.Write(&b, le, uint16(2))
+	binary.Write(&b, le, []uint16{0x013B, 2})
+	binary.Write(&b, le, uint32(4))
+	b.WriteString("kim\x00")
+	binary.Write(&b, le, []uint16{exifTagExifIFD, typ})
+	binary.Write(&b, le, count)
+	binary.Write(&b, le, uint32(38))
+	binary.Write(&b, le, uint32(0))
+
+	// Exif IFD at 38: 1 entry.
+	binary.Write(&b, le, uint16(1))
+	binary.Write(&b, le, []uint16{0x9003, 2})
+	binary.Write(&b, le, uint32(4))
+	b.WriteString("now\x00")
+	binary.Write(&b, le, uint32(0))
+
+	return append(append([]byte{}, exifHeader...), b.Bytes()...)
+}
+
+func TestFilterExif(t *testing.T) {
+	keepAll := func(ifd int, tag uint16) bool { return true }
+
+	out, err := filterExif(testExif(4, 1), keepAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, []byte("kim")) || !bytes.Contains(out, []byte("now")) {
+		t.Errorf("entries of IFD0 and Exif IFD should be kept, got %q", out)
+	}
+
+	out, err = filterExif(testExif(13, 1), keepAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, []byte("now")) {
+		t.Errorf("sub ifd of IFD typed pointer should be kept, got %q", out)
+	}
+
+	out, err = filterExif(testExif(4, 1), func(ifd int, tag uint16) bool { return ifd != exifIFDExif })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("now")) {
+		t.Errorf("entries of Exif IFD should be dropped, got %q", out)
+	}
+}
+
+func TestFilterExifMalformed(t *testing.T) {
+	keepAll := func(ifd int, tag uint16) bool { return true }
+
+	// pointers shorter than 4 bytes or not a single LONG are dropped with their sub ifd.
+	for _, c := range []struct {
+		typ   uint16
+		count uint32
+	}{{1, 1}, {3, 1}, {1, 2}, {4, 2}, {2, 1}, {99, 1}} {
+		out, err := filterExif(testExif(c.typ, c.count), keepAll)
+		if err != nil {
+			t.Fatalf("typ %d count %d: %s", c.typ, c.count, err)
+		}
+		if bytes.Contains(out, []byte("now")) {
+			t.Errorf("typ %d count %d: malformed pointer should be dropped", c.typ, c.count)
+		}
+	}
+
+	// truncated segments never panic.
+	profile := testExif(4, 1)
+	for i := 0; i < len(profile); i++ {
+		filterExif(profile[:i], keepAll)
+	}
+
+	for _, profile := range [][]byte{
+		nil,
+		exifHeader,
+		[]byte("Exif\x00\x00XX\x2a\x00\x08\x00\x00\x00"),
+		[]byte("Exif\x00\x00II\x2a\x00\xff\xff\xff\xff"),
+		[]byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\xff\xff"),
+	} {
+		filterExif(profile, keepAll)
+	}
+}
@@ -0,0 +1,200 @@
+package kimg
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+// KimgNegativeCache remember images missing in storage for a short while, so that requests of them
+// return not found without touching storage. With bloom enabled, md5 of images in storage are loaded
+// into a bloom filter, and md5 not in it are taken as missing once loaded.
+type KimgNegativeCache struct {
+	ctx     *KimgContext
+	ttl     time.Duration
+	size    int
+	mtx     sync.RWMutex
+	missing map[string]time.Time
+	bloom   *kimgBloom
+	loading map[string]bool
+	done    chan struct{}
+}
+
+// kimgBloom is a bloom filter of strings, by double hashing of fnv-1 and fnv-1a.
+type kimgBloom struct {
+	bits []uint64
+	k    uint64
+}
+
+// NewKimgNegativeCache create a negative cache instance, and start loading bloom filter if enabled.
+func NewKimgNegativeCache(ctx *KimgContext) *KimgNegativeCache {
+	negative := &KimgNegativeCache{
+		ctx:     ctx,
+		ttl:     time.Duration(ctx.Config.Cache.Negative.TTL) * time.Second,
+		size:    ctx.Config.Cache.Negative.Size,
+		missing: make(map[string]time.Time),
+		done:    make(chan struct{}),
+	}
+	if ctx.Config.Cache.Negative.Bloom.Enable {
+		go negative.loadLoop()
+	}
+	return negative
+}
+
+// Missing check whether a image is known missing in storage.
+func (negative *KimgNegativeCache) Missing(md5Sum string) bool {
+	negative.mtx.RLock()
+	defer negative.mtx.RUnlock()
+
+	if expire, ok := negative.missing[md5Sum]; ok && time.Now().Before(expire) {
+		return true
+	}
+	return negative.bloom != nil && !negative.bloom.Has(md5Sum)
+}
+
+// SetMissing remember a image missing in storage for ttl.
+func (negative *KimgNegativeCache) SetMissing(md5Sum string) {
+	negative.mtx.Lock()
+	defer negative.mtx.Unlock()
+
+	now := time.Now()
+	if len(negative.missing) >= negative.size {
+		for k, expire := range negative.missing {
+			if now.After(expire) {
+				delete(negative.missing, k)
+			}
+		}
+		if len(negative.missing) >= negative.size {
+			return
+		}
+	}
+	negative.missing[md5Sum] = now.Add(negative.ttl)
+}
+
+// Add forget a image missing, as it is saved or found.
+func (negative *KimgNegativeCache) Add(md5Sum string) {
+	negative.mtx.Lock()
+	defer negative.mtx.Unlock()
+
+	delete(negative.missing, md5Sum)
+	if negative.bloom != nil {
+		negative.bloom.Add(md5Sum)
+	}
+	if negative.loading != nil {
+		negative.loading[md5Sum] = true
+	}
+}
+
+// Close stop reloading bloom filter.
+func (negative *KimgNegativeCache) Close() {
+	close(negative.done)
+}
+
+// loadLoop load bloom filter from storage, and reload it every refresh seconds,
+// as images saved by other kimg instances are not added.
+func (negative *KimgNegativeCache) loadLoop() {
+	negative.load()
+
+	refresh := negative.ctx.Config.Cache.Negative.Bloom.Refresh
+	if refresh <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(refresh) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			negative.load()
+		case <-negative.done:
+			return
+		}
+	}
+}
+
+// load walk through all origin images in storage and build a new bloom filter of their md5,
+// the current one is used until the new one loaded, md5 added while loading are recorded into both.
+func (negative *KimgNegativeCache) load() {
+	config := negative.ctx.Config.Cache.Negative.Bloom
+	bloom := newKimgBloom(config.Capacity, config.FalsePositive)
+
+	negative.mtx.Lock()
+	negative.loading = make(map[string]bool)
+	negative.mtx.Unlock()
+
+	cursor := ""
+	count := 0
+	for {
+		items, next, err := negative.ctx.Storage.List(cursor, 1000)
+		if err != nil {
+			negative.ctx.Logger.Warn("NegativeCache Load cursor: %s, ListStorage err: %s", cursor, err)
+			negative.mtx.Lock()
+			negative.loading = nil
+			negative.mtx.Unlock()
+			return
+		}
+		for _, item := range items {
+			bloom.Add(item.Md5)
+			count++
+		}
+		if len(next) == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	negative.mtx.Lock()
+	for md5Sum := range negative.loading {
+		bloom.Add(md5Sum)
+	}
+	negative.loading = nil
+	negative.bloom = bloom
+	negative.mtx.Unlock()
+
+	negative.ctx.Logger.Info("NegativeCache Load %d images", count)
+}
+
+// newKimgBloom create a bloom filter of n items with false positive rate p.
+func newKimgBloom(n int, p float64) *kimgBloom {
+	if n <= 0 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(n)*math.Ln2))
+	return &kimgBloom{
+		bits: make([]uint64, (uint64(m)+63)/64),
+		k:    uint64(k),
+	}
+}
+
+func (bloom *kimgBloom) Add(s string) {
+	h1, h2 := bloomHash(s)
+	m := uint64(len(bloom.bits)) * 64
+	for i := uint64(0); i < bloom.k; i++ {
+		bit := (h1 + i*h2) % m
+		bloom.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (bloom *kimgBloom) Has(s string) bool {
+	h1, h2 := bloomHash(s)
+	m := uint64(len(bloom.bits)) * 64
+	for i := uint64(0); i < bloom.k; i++ {
+		bit := (h1 + i*h2) % m
+		if bloom.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func bloomHash(s string) (uint64, uint64) {
+	h1 := fnv.New64()
+	h1.Write([]byte(s))
+	h2 := fnv.New64a()
+	h2.Write([]byte(s))
+	return h1.Sum64(), h2.Sum64() | 1
+}
@@ -0,0 +1,146 @@
+package kimg
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// KimgPHashIndex in-memory index of image perceptual hashes for near-duplicate search.
+type KimgPHashIndex struct {
+	ctx    *KimgContext
+	mtx    sync.RWMutex
+	hashes map[string]uint64
+}
+
+// KimgSimilar define a near-duplicate image found in index.
+type KimgSimilar struct {
+	Md5      string `json:"md5"`
+	URL      string `json:"url"`
+	Distance int    `json:"distance"`
+}
+
+// NewKimgPHashIndex create a perceptual hash index instance.
+func NewKimgPHashIndex(ctx *KimgContext) *KimgPHashIndex {
+	return &KimgPHashIndex{
+		ctx:    ctx,
+		hashes: make(map[string]uint64),
+	}
+}
+
+// Load walk through all origin images in storage and add their perceptual hash to index,
+// hashes not saved yet are computed and saved.
+func (index *KimgPHashIndex) Load() {
+	cursor := ""
+	count := 0
+	for {
+		items, next, err := index.ctx.Storage.List(cursor, 1000)
+		if err != nil {
+			index.ctx.Logger.Warn("PHashIndex Load cursor: %s, ListStorage err: %s", cursor, err)
+			return
+		}
+		for _, item := range items {
+			if _, err := index.Get(item.Md5); err == nil {
+				count++
+			}
+		}
+		if len(next) == 0 {
+			break
+		}
+		cursor = next
+	}
+	index.ctx.Logger.Info("PHashIndex Load %d images", count)
+}
+
+// Get get the perceptual hash of a image from index, metadata of origin image, or compute it from origin image.
+func (index *KimgPHashIndex) Get(md5Sum string) (uint64, error) {
+	index.mtx.RLock()
+	hash, ok := index.hashes[md5Sum]
+	index.mtx.RUnlock()
+	if ok {
+		return hash, nil
+	}
+
+	if meta, err := index.ctx.Storage.GetMeta(index.ctx.originRequest(md5Sum)); err == nil && len(meta.PHash) > 0 {
+		if hash, err = strconv.ParseUint(meta.PHash, 16, 64); err == nil {
+			index.add(md5Sum, hash)
+			return hash, nil
+		}
+	}
+
+	data, err := index.ctx.Storage.Get(index.ctx.originRequest(md5Sum))
+	if err != nil {
+		return 0, err
+	}
+	hash, err = index.ctx.Image.PHash(data)
+	if err != nil {
+		return 0, err
+	}
+	if err := index.Set(md5Sum, hash); err != nil {
+		return 0, err
+	}
+	return hash, nil
+}
+
+// Set save the perceptual hash of a image to metadata of origin image and add it to index,
+// so that it is never served as a image derivative.
+func (index *KimgPHashIndex) Set(md5Sum string, hash uint64) error {
+	req := index.ctx.originRequest(md5Sum)
+	meta, err := index.ctx.Storage.GetMeta(req)
+	if err != nil {
+		index.ctx.Logger.Warn("PHashIndex Set md5Sum: %s, GetMeta err: %s", md5Sum, err)
+		return err
+	}
+	meta.PHash = formatPHash(hash)
+	if err := index.ctx.Storage.SetMeta(req, meta); err != nil {
+		index.ctx.Logger.Warn("PHashIndex Set md5Sum: %s, SetMeta err: %s", md5Sum, err)
+		return err
+	}
+	index.add(md5Sum, hash)
+	return nil
+}
+
+// Del remove a image from index.
+func (index *KimgPHashIndex) Del(md5Sum string) {
+	index.mtx.Lock()
+	defer index.mtx.Unlock()
+
+	delete(index.hashes, md5Sum)
+}
+
+// Search find images whose perceptual hash within distance of hash, nearest first.
+func (index *KimgPHashIndex) Search(hash uint64, distance int) []*KimgSimilar {
+	index.mtx.RLock()
+	defer index.mtx.RUnlock()
+
+	similars := make([]*KimgSimilar, 0)
+	for md5Sum, h := range index.hashes {
+		if d := bits.OnesCount64(hash ^ h); d <= distance {
+			similars = append(similars, &KimgSimilar{
+				Md5:      md5Sum,
+				URL:      index.ctx.imageURL(md5Sum),
+				Distance: d,
+			})
+		}
+	}
+	sort.Slice(similars, func(i, j int) bool {
+		if similars[i].Distance == similars[j].Distance {
+			return similars[i].Md5 < similars[j].Md5
+		}
+		return similars[i].Distance < similars[j].Distance
+	})
+	return similars
+}
+
+func (index *KimgPHashIndex) add(md5Sum string, hash uint64) {
+	index.mtx.Lock()
+	defer index.mtx.Unlock()
+
+	index.hashes[md5Sum] = hash
+}
+
+func formatPHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
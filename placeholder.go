@@ -0,0 +1,210 @@
+package kimg
+
+import (
+	"math"
+	"strings"
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurHash encode rgba pixels to a blurhash string with xComp * yComp components.
+// see https://github.com/woltapp/blurhash/blob/master/Algorithm.md
+func blurHash(xComp, yComp, w, h int, rgba []byte) string {
+	factors := make([][3]float64, 0, xComp*yComp)
+	for y := 0; y < yComp; y++ {
+		for x := 0; x < xComp; x++ {
+			normalisation := 2.0
+			if x == 0 && y == 0 {
+				normalisation = 1.0
+			}
+			var r, g, b float64
+			for j := 0; j < h; j++ {
+				fy := math.Cos(math.Pi * float64(y) * float64(j) / float64(h))
+				for i := 0; i < w; i++ {
+					basis := normalisation * math.Cos(math.Pi*float64(x)*float64(i)/float64(w)) * fy
+					p := (j*w + i) * 4
+					r += basis * srgbToLinear(rgba[p])
+					g += basis * srgbToLinear(rgba[p+1])
+					b += basis * srgbToLinear(rgba[p+2])
+				}
+			}
+			scale := 1.0 / float64(w*h)
+			factors = append(factors, [3]float64{r * scale, g * scale, b * scale})
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(encode83((xComp-1)+(yComp-1)*9, 1))
+
+	maxValue := 1.0
+	if len(factors) > 1 {
+		actualMax := 0.0
+		for _, f := range factors[1:] {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		sb.WriteString(encode83(quantisedMax, 1))
+	} else {
+		sb.WriteString(encode83(0, 1))
+	}
+
+	dc := factors[0]
+	sb.WriteString(encode83(linearToSrgb(dc[0])<<16+linearToSrgb(dc[1])<<8+linearToSrgb(dc[2]), 4))
+
+	for _, f := range factors[1:] {
+		quant := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		sb.WriteString(encode83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2))
+	}
+
+	return sb.String()
+}
+
+// thumbHash encode rgba pixels (at most 100x100) to a thumbhash.
+// see https://github.com/evanw/thumbhash
+func thumbHash(w, h int, rgba []byte) []byte {
+	var avgR, avgG, avgB, avgA float64
+	for i := 0; i < w*h; i++ {
+		alpha := float64(rgba[i*4+3]) / 255
+		avgR += alpha / 255 * float64(rgba[i*4])
+		avgG += alpha / 255 * float64(rgba[i*4+1])
+		avgB += alpha / 255 * float64(rgba[i*4+2])
+		avgA += alpha
+	}
+	if avgA > 0 {
+		avgR /= avgA
+		avgG /= avgA
+		avgB /= avgA
+	}
+
+	hasAlpha := avgA < float64(w*h)
+	lLimit := 7.0
+	if hasAlpha {
+		lLimit = 5.0
+	}
+	maxWH := float64(w)
+	if h > w {
+		maxWH = float64(h)
+	}
+	lx := maxInt(1, round(lLimit*float64(w)/maxWH))
+	ly := maxInt(1, round(lLimit*float64(h)/maxWH))
+
+	l := make([]float64, w*h)
+	p := make([]float64, w*h)
+	q := make([]float64, w*h)
+	a := make([]float64, w*h)
+	for i := 0; i < w*h; i++ {
+		alpha := float64(rgba[i*4+3]) / 255
+		r := avgR*(1-alpha) + alpha/255*float64(rgba[i*4])
+		g := avgG*(1-alpha) + alpha/255*float64(rgba[i*4+1])
+		b := avgB*(1-alpha) + alpha/255*float64(rgba[i*4+2])
+		l[i] = (r + g + b) / 3
+		p[i] = (r+g)/2 - b
+		q[i] = r - g
+		a[i] = alpha
+	}
+
+	encodeChannel := func(channel []float64, nx, ny int) (float64, []float64, float64) {
+		var dc, scale float64
+		var ac []float64
+		fx := make([]float64, w)
+		for cy := 0; cy < ny; cy++ {
+			for cx := 0; cx*ny < nx*(ny-cy); cx++ {
+				f := 0.0
+				for x := 0; x < w; x++ {
+					fx[x] = math.Cos(math.Pi / float64(w) * float64(cx) * (float64(x) + 0.5))
+				}
+				for y := 0; y < h; y++ {
+					fy := math.Cos(math.Pi / float64(h) * float64(cy) * (float64(y) + 0.5))
+					for x := 0; x < w; x++ {
+						f += channel[x+y*w] * fx[x] * fy
+					}
+				}
+				f /= float64(w * h)
+				if cx > 0 || cy > 0 {
+					ac = append(ac, f)
+					scale = math.Max(scale, math.Abs(f))
+				} else {
+					dc = f
+				}
+			}
+		}
+		if scale > 0 {
+			for i := range ac {
+				ac[i] = 0.5 + 0.5/scale*ac[i]
+			}
+		}
+		return dc, ac, scale
+	}
+
+	lDC, lAC, lScale := encodeChannel(l, maxInt(3, lx), maxInt(3, ly))
+	pDC, pAC, pScale := encodeChannel(p, 3, 3)
+	qDC, qAC, qScale := encodeChannel(q, 3, 3)
+
+	isLandscape := w > h
+	header24 := round(63*lDC) | round(31.5+31.5*pDC)<<6 | round(31.5+31.5*qDC)<<12 | round(31*lScale)<<18 | boolInt(hasAlpha)<<23
+	header16 := round(63*pScale)<<3 | round(63*qScale)<<9 | boolInt(isLandscape)<<15
+	if isLandscape {
+		header16 |= ly
+	} else {
+		header16 |= lx
+	}
+	hash := []byte{byte(header24), byte(header24 >> 8), byte(header24 >> 16), byte(header16), byte(header16 >> 8)}
+
+	acs := [][]float64{lAC, pAC, qAC}
+	if hasAlpha {
+		aDC, aAC, aScale := encodeChannel(a, 5, 5)
+		hash = append(hash, byte(round(15*aDC)|round(15*aScale)<<4))
+		acs = append(acs, aAC)
+	}
+
+	index := 0
+	for _, ac := range acs {
+		for _, f := range ac {
+			if index&1 == 0 {
+				hash = append(hash, 0)
+			}
+			hash[len(hash)-1] |= byte(round(15*f) << ((index & 1) << 2))
+			index++
+		}
+	}
+	return hash
+}
+
+func encode83(value, length int) string {
+	var sb strings.Builder
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		sb.WriteByte(base83Chars[digit])
+	}
+	return sb.String()
+}
+
+func srgbToLinear(value byte) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return round(v * 12.92 * 255)
+	}
+	return round((1.055*math.Pow(v, 1/2.4) - 0.055) * 255)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
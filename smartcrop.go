@@ -0,0 +1,138 @@
+package kimg
+
+import (
+	"math"
+)
+
+// smartCropWindow find the top left position of a cw * ch crop window in a w * h rgb image
+// which keeps the most interesting part according to the strategy.
+func smartCropWindow(strategy string, w, h int, rgb []byte, cw, ch int) (int, int) {
+	if cw >= w && ch >= h {
+		return 0, 0
+	}
+	if cw > w {
+		cw = w
+	}
+	if ch > h {
+		ch = h
+	}
+
+	switch strategy {
+	case "entropy":
+		return entropyCropWindow(w, h, rgb, cw, ch)
+	default:
+		return attentionCropWindow(w, h, rgb, cw, ch)
+	}
+}
+
+// entropyCropWindow repeatedly remove the edge slice with the lower entropy until the window fits.
+func entropyCropWindow(w, h int, rgb []byte, cw, ch int) (int, int) {
+	luma := lumaPixels(w, h, rgb)
+	x0, y0, x1, y1 := 0, 0, w, h
+
+	for x1-x0 > cw {
+		slice := minInt(x1-x0-cw, maxInt(1, (x1-x0)/10))
+		left := regionEntropy(luma, w, x0, y0, x0+slice, y1)
+		right := regionEntropy(luma, w, x1-slice, y0, x1, y1)
+		if left < right {
+			x0 += slice
+		} else {
+			x1 -= slice
+		}
+	}
+	for y1-y0 > ch {
+		slice := minInt(y1-y0-ch, maxInt(1, (y1-y0)/10))
+		top := regionEntropy(luma, w, x0, y0, x1, y0+slice)
+		bottom := regionEntropy(luma, w, x0, y1-slice, x1, y1)
+		if top < bottom {
+			y0 += slice
+		} else {
+			y1 -= slice
+		}
+	}
+	return x0, y0
+}
+
+// attentionCropWindow choose the window with the largest saliency made of edges, saturation and skin tones.
+func attentionCropWindow(w, h int, rgb []byte, cw, ch int) (int, int) {
+	luma := lumaPixels(w, h, rgb)
+
+	// summed area table of saliency, with a leading zero row and column.
+	sat := make([]float64, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		rowSum := 0.0
+		for x := 0; x < w; x++ {
+			i := y*w + x
+			r := float64(rgb[i*3]) / 255
+			g := float64(rgb[i*3+1]) / 255
+			b := float64(rgb[i*3+2]) / 255
+
+			edge := 4 * luma[i]
+			edge -= luma[y*w+maxInt(0, x-1)] + luma[y*w+minInt(w-1, x+1)]
+			edge -= luma[maxInt(0, y-1)*w+x] + luma[minInt(h-1, y+1)*w+x]
+
+			maxC := math.Max(r, math.Max(g, b))
+			minC := math.Min(r, math.Min(g, b))
+			saturation := 0.0
+			if maxC > 0 && luma[i] > 0.05 && luma[i] < 0.9 {
+				saturation = (maxC - minC) / maxC
+			}
+
+			skin := 0.0
+			if mag := math.Sqrt(r*r + g*g + b*b); mag > 0 {
+				dr, dg, db := r/mag-0.78, g/mag-0.57, b/mag-0.44
+				if d := 1 - math.Sqrt(dr*dr+dg*dg+db*db); d > 0.8 && luma[i] > 0.2 && luma[i] < 1 {
+					skin = (d - 0.8) / 0.2
+				}
+			}
+
+			rowSum += math.Abs(edge) + 0.3*saturation + 0.6*skin
+			sat[(y+1)*(w+1)+x+1] = sat[y*(w+1)+x+1] + rowSum
+		}
+	}
+
+	best := -1.0
+	bestX, bestY := 0, 0
+	bestDist := math.MaxFloat64
+	cx := float64(w-cw) / 2
+	cy := float64(h-ch) / 2
+	for y := 0; y <= h-ch; y++ {
+		for x := 0; x <= w-cw; x++ {
+			score := sat[(y+ch)*(w+1)+x+cw] - sat[y*(w+1)+x+cw] - sat[(y+ch)*(w+1)+x] + sat[y*(w+1)+x]
+			dist := (float64(x)-cx)*(float64(x)-cx) + (float64(y)-cy)*(float64(y)-cy)
+			if score > best+1e-9 || (math.Abs(score-best) <= 1e-9 && dist < bestDist) {
+				best = score
+				bestX, bestY = x, y
+				bestDist = dist
+			}
+		}
+	}
+	return bestX, bestY
+}
+
+func lumaPixels(w, h int, rgb []byte) []float64 {
+	luma := make([]float64, w*h)
+	for i := range luma {
+		luma[i] = (0.299*float64(rgb[i*3]) + 0.587*float64(rgb[i*3+1]) + 0.114*float64(rgb[i*3+2])) / 255
+	}
+	return luma
+}
+
+func regionEntropy(luma []float64, stride, x0, y0, x1, y1 int) float64 {
+	var hist [256]int
+	n := 0
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			hist[minInt(255, int(luma[y*stride+x]*255))]++
+			n++
+		}
+	}
+	entropy := 0.0
+	for _, c := range hist {
+		if c > 0 {
+			p := float64(c) / float64(n)
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
@@ -3,13 +3,27 @@ package kimg
 import (
 	"errors"
 	"log"
+	"time"
 )
 
+// ErrImageNotExist returned by storage Get when the image not exist.
+var ErrImageNotExist = errors.New("image not exist")
+
 // KimgStorage is a interface to provide storage in kimg.
 type KimgStorage interface {
 	Set(req *KimgRequest, data []byte) error
 	Get(req *KimgRequest) ([]byte, error)
 	Del(req *KimgRequest) error
+	List(cursor string, limit int) ([]*KimgStorageItem, string, error)
+	SetMeta(req *KimgRequest, meta *KimgMeta) error
+	GetMeta(req *KimgRequest) (*KimgMeta, error)
+}
+
+// KimgStorageItem define a origin image listed from storage.
+type KimgStorageItem struct {
+	Md5     string
+	Size    int64
+	Created time.Time
 }
 
 // KimgBaseStorage base storage struct hold kimg context.
@@ -1,13 +1,19 @@
 package kimg
 
 import (
+	"encoding/json"
+	"errors"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 )
 
+var errListDone = errors.New("list done")
+
 type kimgFileStorage struct {
 	rootDir string
 	mtx     sync.RWMutex
@@ -54,7 +60,10 @@ func (storage *kimgFileStorage) Get(req *KimgRequest) ([]byte, error) {
 	defer storage.mtx.RUnlock()
 
 	data, err := ioutil.ReadFile(imageFile)
-	if err != nil {
+	if os.IsNotExist(err) {
+		storage.Debug("kimgFileStorage Get file: %s, not exist", imageFile)
+		return nil, ErrImageNotExist
+	} else if err != nil {
 		storage.Warn("ReadFile %s, err: %s", imageFile, err)
 		return nil, err
 	}
@@ -81,6 +90,123 @@ func (storage *kimgFileStorage) Del(req *KimgRequest) error {
 	return nil
 }
 
+func (storage *kimgFileStorage) List(cursor string, limit int) ([]*KimgStorageItem, string, error) {
+	storage.mtx.RLock()
+	defer storage.mtx.RUnlock()
+
+	after := ""
+	if len(cursor) > 0 {
+		cursorDir, _ := storage.imageDirAndFile(&KimgRequest{Md5: cursor, Origin: true})
+		after, _ = filepath.Rel(storage.rootDir, cursorDir)
+		after = filepath.ToSlash(after)
+	}
+
+	items := make([]*KimgStorageItem, 0, limit)
+	next := ""
+
+	err := filepath.WalkDir(storage.rootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == storage.rootDir && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.IsDir() || path == storage.rootDir {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(storage.rootDir, path)
+		rel = filepath.ToSlash(rel)
+		if rel <= after && !strings.HasPrefix(after, rel+"/") {
+			return filepath.SkipDir
+		}
+		if strings.Count(rel, "/") < 2 {
+			return nil
+		}
+
+		fi, err := os.Stat(filepath.Join(path, "origin"))
+		if err != nil {
+			return filepath.SkipDir
+		}
+		if len(items) >= limit {
+			next = items[len(items)-1].Md5
+			return errListDone
+		}
+		items = append(items, &KimgStorageItem{
+			Md5:     d.Name(),
+			Size:    fi.Size(),
+			Created: fi.ModTime(),
+		})
+		return filepath.SkipDir
+	})
+	if err != nil && err != errListDone {
+		storage.Warn("WalkDir %s, err: %s", storage.rootDir, err)
+		return nil, "", err
+	}
+
+	storage.Debug("kimgFileStorage List cursor: %s, count: %d, next: %s", cursor, len(items), next)
+
+	return items, next, nil
+}
+
+func (storage *kimgFileStorage) SetMeta(req *KimgRequest, meta *KimgMeta) error {
+	imageDir, imageFile := storage.imageDirAndFile(req)
+	metaFile := filepath.Join(imageDir, "meta.json")
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+
+	if _, err := os.Stat(imageFile); err != nil {
+		storage.Warn("Stat %s, err: %s", imageFile, err)
+		return err
+	}
+
+	err = ioutil.WriteFile(metaFile, data, 0644)
+	if err != nil {
+		storage.Warn("WriteFile %s, err: %s", metaFile, err)
+		return err
+	}
+
+	storage.Debug("kimgFileStorage SetMeta file: %s, size: %d", metaFile, len(data))
+
+	return nil
+}
+
+func (storage *kimgFileStorage) GetMeta(req *KimgRequest) (*KimgMeta, error) {
+	imageDir, imageFile := storage.imageDirAndFile(req)
+	metaFile := filepath.Join(imageDir, "meta.json")
+
+	storage.mtx.RLock()
+	defer storage.mtx.RUnlock()
+
+	var meta KimgMeta
+	data, err := ioutil.ReadFile(metaFile)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(imageFile); err != nil {
+			storage.Warn("Stat %s, err: %s", imageFile, err)
+			return nil, err
+		}
+		return &meta, nil
+	} else if err != nil {
+		storage.Warn("ReadFile %s, err: %s", metaFile, err)
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &meta); err != nil {
+		storage.Warn("Unmarshal %s, err: %s", metaFile, err)
+		return nil, err
+	}
+
+	storage.Debug("kimgFileStorage GetMeta file: %s, size: %d", metaFile, len(data))
+
+	return &meta, nil
+}
+
 func (storage *kimgFileStorage) imageDirAndFile(req *KimgRequest) (string, string) {
 	l1, _ := strconv.ParseUint(req.Md5[:3], 16, 0)
 	l2, _ := strconv.ParseUint(req.Md5[3:6], 16, 0)
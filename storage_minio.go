@@ -3,13 +3,19 @@ package kimg
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"io/ioutil"
+	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
+const minioMetaKey = "Kimg-Meta"
+
 type kimgMinioStorage struct {
 	client *minio.Client
 	bucket string
@@ -47,7 +53,16 @@ func NewKimgMinioStorage(ctx *KimgContext) (KimgStorage, error) {
 func (storage *kimgMinioStorage) Set(req *KimgRequest, data []byte) error {
 	imageDir, imageFile := storage.imageDirAndFile(req)
 
-	_, err := storage.client.PutObject(context.Background(), storage.bucket, imageFile, bytes.NewReader(data), -1, minio.PutObjectOptions{})
+	opts := minio.PutObjectOptions{}
+	if req.Origin {
+		if info, err := storage.client.StatObject(context.Background(), storage.bucket, imageFile, minio.StatObjectOptions{}); err == nil {
+			if v, ok := info.UserMetadata[minioMetaKey]; ok {
+				opts.UserMetadata = map[string]string{minioMetaKey: v}
+			}
+		}
+	}
+
+	_, err := storage.client.PutObject(context.Background(), storage.bucket, imageFile, bytes.NewReader(data), -1, opts)
 	if err != nil {
 		return err
 	}
@@ -68,6 +83,9 @@ func (storage *kimgMinioStorage) Get(req *KimgRequest) ([]byte, error) {
 
 	data, err := ioutil.ReadAll(object)
 	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrImageNotExist
+		}
 		return nil, err
 	}
 
@@ -89,6 +107,95 @@ func (storage *kimgMinioStorage) Del(req *KimgRequest) error {
 	return nil
 }
 
+func (storage *kimgMinioStorage) List(cursor string, limit int) ([]*KimgStorageItem, string, error) {
+	context, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := minio.ListObjectsOptions{Recursive: true}
+	if len(cursor) > 0 {
+		opts.StartAfter = path.Join(cursor, "origin")
+	}
+
+	items := make([]*KimgStorageItem, 0, limit)
+	next := ""
+	for object := range storage.client.ListObjects(context, storage.bucket, opts) {
+		if object.Err != nil {
+			storage.Warn("ListObjects %s, err: %s", storage.bucket, object.Err)
+			return nil, "", object.Err
+		}
+		if !strings.HasSuffix(object.Key, "/origin") {
+			continue
+		}
+		if len(items) >= limit {
+			next = items[len(items)-1].Md5
+			break
+		}
+		items = append(items, &KimgStorageItem{
+			Md5:     path.Dir(object.Key),
+			Size:    object.Size,
+			Created: object.LastModified,
+		})
+	}
+
+	storage.Debug("kimgMinioStorage List cursor: %s, count: %d, next: %s", cursor, len(items), next)
+
+	return items, next, nil
+}
+
+func (storage *kimgMinioStorage) SetMeta(req *KimgRequest, meta *KimgMeta) error {
+	_, imageFile := storage.imageDirAndFile(req)
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	dst := minio.CopyDestOptions{
+		Bucket:          storage.bucket,
+		Object:          imageFile,
+		UserMetadata:    map[string]string{minioMetaKey: base64.StdEncoding.EncodeToString(data)},
+		ReplaceMetadata: true,
+	}
+	src := minio.CopySrcOptions{
+		Bucket: storage.bucket,
+		Object: imageFile,
+	}
+	if _, err := storage.client.CopyObject(context.Background(), dst, src); err != nil {
+		return err
+	}
+
+	storage.Debug("kimgMinioStorage SetMeta file: %s, size: %d", imageFile, len(data))
+
+	return nil
+}
+
+func (storage *kimgMinioStorage) GetMeta(req *KimgRequest) (*KimgMeta, error) {
+	_, imageFile := storage.imageDirAndFile(req)
+
+	info, err := storage.client.StatObject(context.Background(), storage.bucket, imageFile, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var meta KimgMeta
+	v, ok := info.UserMetadata[minioMetaKey]
+	if !ok {
+		return &meta, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+
+	storage.Debug("kimgMinioStorage GetMeta file: %s, size: %d", imageFile, len(data))
+
+	return &meta, nil
+}
+
 func (storage *kimgMinioStorage) imageDirAndFile(req *KimgRequest) (string, string) {
 	imageDir := req.Md5
 	imageFile := ""